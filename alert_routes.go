@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/joomcode/errorx"
+	"go.uber.org/zap/zapcore"
+)
+
+// alert route destinations
+const (
+	routeSlack   = "slack"
+	routeDiscord = "discord"
+	routeTeams   = "teams"
+	routeEmail   = "email"
+	routeWebhook = "webhook"
+)
+
+// alertRoutesFile is the JSON file given to --alert-routes
+type alertRoutesFile struct {
+	Routes []*alertRoute `json:"routes"`
+}
+
+// alertRoute sends the entries it matches to one destination. An entry matches when its level is
+// within Level and MaxLevel, its logger is Logger or below it, Message matches its message and
+// every field in Fields has the given value.
+type alertRoute struct {
+	Name string `json:"name"`
+	// Type is slack, discord, teams, email or webhook
+	Type string `json:"type"`
+	URL  string `json:"url"`
+	// To are the recipients of an email route
+	To []string `json:"to"`
+
+	Level    string            `json:"level"`
+	MaxLevel string            `json:"max_level"`
+	Logger   string            `json:"logger"`
+	Message  string            `json:"message"`
+	Fields   map[string]string `json:"fields"`
+	// Summaries sends run summaries to the route besides the entries it matches
+	Summaries bool `json:"summaries"`
+
+	// Format is how a slack route renders from a level up, like --slack-format
+	Format map[string]string `json:"format"`
+	// Template renders the body of a webhook route, like the file given to --webhook-template
+	Template string `json:"template"`
+	// Rate is the most deliveries per second with bursts of up to Burst, 0 keeps the destination's default
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+
+	level    zapcore.Level
+	maxLevel zapcore.Level
+	message  *regexp.Regexp
+	formats  map[zapcore.Level]slackFormat
+}
+
+// loadAlertRoutes reads and checks the routes in path
+func loadAlertRoutes(path string) ([]*alertRoute, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to open alert routes")
+	}
+	defer f.Close()
+	var file alertRoutesFile
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, errorx.IllegalArgument.Wrap(err, "failed to read alert routes %s", path)
+	}
+	names := make(map[string]bool, len(file.Routes))
+	for i, route := range file.Routes {
+		if route.Name == "" {
+			return nil, errorx.IllegalArgument.New("alert route %d has no name", i+1)
+		}
+		if names[route.Name] {
+			return nil, errorx.IllegalArgument.New("alert route %s is defined twice", route.Name)
+		}
+		names[route.Name] = true
+		if err := route.compile(); err != nil {
+			return nil, errorx.Decorate(err, "alert route %s", route.Name)
+		}
+	}
+	return file.Routes, nil
+}
+
+// compile checks the route and parses its levels, message pattern and format
+func (r *alertRoute) compile() error {
+	switch r.Type {
+	case routeSlack, routeDiscord, routeTeams, routeWebhook:
+		if r.URL == "" {
+			return errorx.IllegalArgument.New("a %s route needs a url", r.Type)
+		}
+	case routeEmail:
+		if len(r.To) == 0 {
+			return errorx.IllegalArgument.New("an email route needs recipients in to")
+		}
+	default:
+		return errorx.IllegalArgument.New("unknown type %q, pick from slack, discord, teams, email, webhook", r.Type)
+	}
+	r.level, r.maxLevel = zapcore.ErrorLevel, zapcore.FatalLevel
+	if r.Level != "" {
+		if err := r.level.UnmarshalText([]byte(r.Level)); err != nil {
+			return errorx.IllegalArgument.Wrap(err, "bad level")
+		}
+	}
+	if r.MaxLevel != "" {
+		if err := r.maxLevel.UnmarshalText([]byte(r.MaxLevel)); err != nil {
+			return errorx.IllegalArgument.Wrap(err, "bad max_level")
+		}
+	}
+	if r.maxLevel < r.level {
+		return errorx.IllegalArgument.New("max_level %s is below level %s", r.maxLevel, r.level)
+	}
+	if r.Message != "" {
+		var err error
+		if r.message, err = regexp.Compile(r.Message); err != nil {
+			return errorx.IllegalArgument.Wrap(err, "bad message pattern")
+		}
+	}
+	if r.Format != nil {
+		if r.Type != routeSlack {
+			return errorx.IllegalArgument.New("format only applies to slack routes")
+		}
+		var err error
+		if r.formats, err = parseSlackFormats(r.Format); err != nil {
+			return err
+		}
+	}
+	if r.Template != "" && r.Type != routeWebhook {
+		return errorx.IllegalArgument.New("template only applies to webhook routes")
+	}
+	if r.Rate < 0 || r.Burst < 0 {
+		return errorx.IllegalArgument.New("rate and burst can't be negative")
+	}
+	return nil
+}
+
+// limiter is the rate limit of the route, nil when it keeps the destination's default
+func (r *alertRoute) limiter() *tokenBucket {
+	if r.Rate == 0 {
+		return nil
+	}
+	burst := r.Burst
+	if burst == 0 {
+		burst = 1
+	}
+	return newTokenBucket(r.Rate, burst)
+}
+
+func (r *alertRoute) enabled(level zapcore.Level) bool {
+	return level >= r.level && level <= r.maxLevel
+}
+
+// matchesEntry checks everything but the fields, which are only known once the entry is written
+func (r *alertRoute) matchesEntry(entry zapcore.Entry) bool {
+	if !r.enabled(entry.Level) {
+		return false
+	}
+	if r.Logger != "" && entry.LoggerName != r.Logger && !strings.HasPrefix(entry.LoggerName, r.Logger+".") {
+		return false
+	}
+	return r.message == nil || r.message.MatchString(entry.Message)
+}
+
+func (r *alertRoute) matchesFields(fields []zapcore.Field) bool {
+	if len(r.Fields) == 0 {
+		return true
+	}
+	enc := zapcore.NewMapObjectEncoder()
+	for _, field := range fields {
+		field.AddTo(enc)
+	}
+	for key, want := range r.Fields {
+		value, ok := enc.Fields[key]
+		if !ok || fieldText(value) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// routeCore hands the entries its route matches to a notifier
+type routeCore struct {
+	route    *alertRoute
+	notifier Notifier
+	// core is notifier with the fields added by With
+	core   zapcore.Core
+	fields []zapcore.Field
+}
+
+func newRouteCore(route *alertRoute, notifier Notifier) *routeCore {
+	return &routeCore{route: route, notifier: notifier, core: notifier}
+}
+
+func (rc *routeCore) Enabled(lvl zapcore.Level) bool {
+	return rc.route.enabled(lvl)
+}
+
+func (rc *routeCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *rc
+	clone.core = rc.core.With(fields)
+	clone.fields = append(rc.fields[:len(rc.fields):len(rc.fields)], fields...)
+	return &clone
+}
+
+func (rc *routeCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if rc.route.matchesEntry(entry) {
+		return checked.AddCore(entry, rc)
+	}
+	return checked
+}
+
+func (rc *routeCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	if !rc.route.matchesFields(append(rc.fields[:len(rc.fields):len(rc.fields)], fields...)) {
+		return nil
+	}
+	return rc.core.Write(entry, fields)
+}
+
+func (rc *routeCore) Sync() error {
+	return rc.core.Sync()
+}
+
+// NotifyRun passes summary on when the route asks for run summaries
+func (rc *routeCore) NotifyRun(summary *RunSummary) error {
+	if !rc.route.Summaries {
+		return nil
+	}
+	return rc.notifier.NotifyRun(summary)
+}
+
+func (rc *routeCore) Close(ctx context.Context) error {
+	return rc.notifier.Close(ctx)
+}
+
+// Replay resends what a slack route spooled on an earlier run
+func (rc *routeCore) Replay() error {
+	if replayer, ok := rc.notifier.(interface{ Replay() error }); ok {
+		return replayer.Replay()
+	}
+	return nil
+}
+
+// Discard stops a slack route from spooling
+func (rc *routeCore) Discard() {
+	if discarder, ok := rc.notifier.(interface{ Discard() }); ok {
+		discarder.Discard()
+	}
+}
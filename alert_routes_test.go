@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/joomcode/errorx"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func writeAlertRoutes(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "alert-routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "routes.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadAlertRoutes(t *testing.T) {
+	path := writeAlertRoutes(t, `{"routes": [
+		{"name": "oncall", "type": "slack", "url": "https://hooks.slack.com/x", "format": {"error": "blocks"}, "rate": 0.5, "burst": 3},
+		{"name": "team", "type": "discord", "url": "https://discord.com/api/webhooks/x", "level": "info", "max_level": "warn", "summaries": true}
+	]}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	routes, err := loadAlertRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("got %d routes, want 2", len(routes))
+	}
+	oncall, team := routes[0], routes[1]
+	if oncall.level != zapcore.ErrorLevel || oncall.maxLevel != zapcore.FatalLevel {
+		t.Errorf("oncall levels = %s..%s, want error..fatal", oncall.level, oncall.maxLevel)
+	}
+	if oncall.formats[zapcore.ErrorLevel] != slackBlocksFormat {
+		t.Errorf("oncall formats = %v, want blocks from error", oncall.formats)
+	}
+	if limiter := oncall.limiter(); limiter == nil || limiter.rate != 0.5 || limiter.burst != 3 {
+		t.Errorf("oncall limiter = %+v, want 0.5/s bursts of 3", limiter)
+	}
+	if team.level != zapcore.InfoLevel || team.maxLevel != zapcore.WarnLevel || !team.Summaries {
+		t.Errorf("team = %+v, want info..warn with summaries", team)
+	}
+	if team.limiter() != nil {
+		t.Error("team has a limiter, want the destination's default")
+	}
+}
+
+func TestLoadAlertRoutes_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"not json", `{"routes": [`, "failed to read"},
+		{"unknown key", `{"routes": [{"name": "a", "type": "slack", "url": "u", "channel": "x"}]}`, "unknown field"},
+		{"no name", `{"routes": [{"type": "slack", "url": "u"}]}`, "has no name"},
+		{"twice", `{"routes": [{"name": "a", "type": "slack", "url": "u"}, {"name": "a", "type": "teams", "url": "u"}]}`, "defined twice"},
+		{"unknown type", `{"routes": [{"name": "a", "type": "pager", "url": "u"}]}`, "unknown type"},
+		{"no url", `{"routes": [{"name": "a", "type": "discord"}]}`, "needs a url"},
+		{"no recipients", `{"routes": [{"name": "a", "type": "email"}]}`, "needs recipients"},
+		{"bad level", `{"routes": [{"name": "a", "type": "slack", "url": "u", "level": "loud"}]}`, "bad level"},
+		{"levels swapped", `{"routes": [{"name": "a", "type": "slack", "url": "u", "level": "error", "max_level": "info"}]}`, "is below level"},
+		{"bad pattern", `{"routes": [{"name": "a", "type": "slack", "url": "u", "message": "("}]}`, "bad message pattern"},
+		{"bad format", `{"routes": [{"name": "a", "type": "slack", "url": "u", "format": {"error": "fancy"}}]}`, "unknown slack format"},
+		{"format elsewhere", `{"routes": [{"name": "a", "type": "teams", "url": "u", "format": {"error": "text"}}]}`, "only applies to slack"},
+		{"template elsewhere", `{"routes": [{"name": "a", "type": "slack", "url": "u", "template": "{}"}]}`, "only applies to webhook"},
+		{"negative rate", `{"routes": [{"name": "a", "type": "slack", "url": "u", "rate": -1}]}`, "can't be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeAlertRoutes(t, tt.content)
+			defer os.RemoveAll(filepath.Dir(path))
+			_, err := loadAlertRoutes(path)
+			if !errorx.IsOfType(err, errorx.IllegalArgument) || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("loadAlertRoutes() = %v, want an IllegalArgument containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteCore(t *testing.T) {
+	tests := []struct {
+		name  string
+		route alertRoute
+		want  []string
+	}{
+		{
+			name:  "levels",
+			route: alertRoute{Level: "warn", MaxLevel: "error"},
+			want:  []string{"slow alice", "failed alice", "timeout bob"},
+		},
+		{
+			name:  "logger",
+			route: alertRoute{Level: "info", Logger: "collector"},
+			want:  []string{"started alice", "slow alice", "failed alice"},
+		},
+		{
+			name:  "message",
+			route: alertRoute{Level: "debug", Message: "^(failed|timeout)$"},
+			want:  []string{"failed alice", "timeout bob"},
+		},
+		{
+			name:  "fields",
+			route: alertRoute{Level: "debug", Fields: map[string]string{"user": "bob", "status": "504"}},
+			want:  []string{"timeout bob"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := tt.route
+			route.Name, route.Type, route.URL = tt.name, routeWebhook, "http://example.com"
+			if err := route.compile(); err != nil {
+				t.Fatal(err)
+			}
+			sink := &recordingSink{}
+			core := newTestNotifierCore(sink)
+			core.Level = zapcore.DebugLevel
+			log := zap.New(newRouteCore(&route, core))
+
+			collector := log.Named("collector").With(zap.String("user", "alice"))
+			collector.Info("started")
+			collector.Warn("slow")
+			collector.Named("fetch").Error("failed", zap.Int("status", 500))
+			log.Named("other").Error("timeout", zap.String("user", "bob"), zap.Int("status", 504))
+			log.Named("other").DPanic("skipped by max level", zap.String("user", "bob"))
+			core.Sync()
+
+			got := sink.Entries()
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("entries = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteCore_NotifyRun(t *testing.T) {
+	for _, summaries := range []bool{false, true} {
+		sink := &recordingSink{}
+		route := &alertRoute{Summaries: summaries}
+		if err := newRouteCore(route, newTestNotifierCore(sink)).NotifyRun(testRunSummary()); err != nil {
+			t.Fatal(err)
+		}
+		if want := map[bool]int{false: 0, true: 1}[summaries]; sink.runs != want {
+			t.Errorf("summaries %v: runs = %d, want %d", summaries, sink.runs, want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/joomcode/errorx"
+	"go.uber.org/zap"
+)
+
+const (
+	// cacheEntryMagic prefixes every cache entry written through IntegrityCache
+	cacheEntryMagic = "WKCE"
+	// cacheEntryVersion is the current on disk format of a cache entry
+	cacheEntryVersion  byte = 1
+	cacheEntryChecksum      = sha256.Size
+	cacheEntryHeader        = len(cacheEntryMagic) + 1 + cacheEntryChecksum
+)
+
+var (
+	cacheNamespace = errorx.NewNamespace("cache")
+
+	CorruptCacheEntry     = cacheNamespace.NewType("corrupt_entry")
+	UnsupportedCacheEntry = cacheNamespace.NewType("unsupported_entry")
+)
+
+// IntegrityCache wraps a Cache so that every entry carries a format version and
+// a checksum of the stored response. Entries failing verification are evicted
+// and reported as a miss so the request is fetched again.
+type IntegrityCache struct {
+	Cache Cache
+}
+
+// NewIntegrityCache returns a Cache that verifies entries stored in c
+func NewIntegrityCache(c Cache) *IntegrityCache {
+	return &IntegrityCache{Cache: c}
+}
+
+func (c *IntegrityCache) Get(key string) ([]byte, bool) {
+	b, ok := c.Cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	payload, _, err := decodeCacheEntry(b)
+	if err != nil {
+		logger.Warn("Evicting corrupt cache entry", zap.String("key", key), zap.Error(err))
+		c.Cache.Delete(key)
+		return nil, false
+	}
+	return payload, true
+}
+
+func (c *IntegrityCache) Set(key string, responseBytes []byte) {
+	c.Cache.Set(key, encodeCacheEntry(responseBytes))
+}
+
+func (c *IntegrityCache) Delete(key string) {
+	c.Cache.Delete(key)
+}
+
+// encodeCacheEntry prepends the magic, format version and checksum to payload
+func encodeCacheEntry(payload []byte) []byte {
+	sum := sha256.Sum256(payload)
+	b := make([]byte, 0, cacheEntryHeader+len(payload))
+	b = append(b, cacheEntryMagic...)
+	b = append(b, cacheEntryVersion)
+	b = append(b, sum[:]...)
+	return append(b, payload...)
+}
+
+// decodeCacheEntry verifies b and returns the stored payload along with its format version.
+// Entries written before checksums were introduced are returned unchanged as version 0.
+func decodeCacheEntry(b []byte) ([]byte, byte, error) {
+	if !bytes.HasPrefix(b, []byte(cacheEntryMagic)) {
+		return b, 0, nil
+	}
+	if len(b) < cacheEntryHeader {
+		return nil, 0, CorruptCacheEntry.New("truncated header")
+	}
+	version := b[len(cacheEntryMagic)]
+	if version != cacheEntryVersion {
+		return nil, version, UnsupportedCacheEntry.New(fmt.Sprintf("format version %d", version))
+	}
+	sum := b[len(cacheEntryMagic)+1 : cacheEntryHeader]
+	payload := b[cacheEntryHeader:]
+	actual := sha256.Sum256(payload)
+	if !bytes.Equal(sum, actual[:]) {
+		return nil, version, CorruptCacheEntry.New("checksum mismatch")
+	}
+	return payload, version, nil
+}
+
+// verifyCacheEntry checks that b holds a valid entry containing a complete http response
+func verifyCacheEntry(b []byte) (byte, error) {
+	payload, version, err := decodeCacheEntry(b)
+	if err != nil {
+		return version, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(payload)), nil)
+	if err != nil {
+		return version, CorruptCacheEntry.Wrap(err, "unreadable response")
+	}
+	defer resp.Body.Close()
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		return version, CorruptCacheEntry.Wrap(err, "truncated body")
+	}
+	return version, nil
+}
+
+// CacheVerifyReport summarises a scan of a cache directory
+type CacheVerifyReport struct {
+	Checked int
+	Legacy  int
+	Corrupt []string
+	Removed int
+}
+
+// VerifyCacheDir walks dir and checks every cache entry found in it.
+// Corrupt entries are removed when clean is set.
+func VerifyCacheDir(dir string, clean bool) (*CacheVerifyReport, error) {
+	report := &CacheVerifyReport{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isCacheEntryName(info.Name()) {
+			return nil
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		report.Checked++
+		version, err := verifyCacheEntry(b)
+		if err != nil {
+			logger.Warn("Corrupt cache entry", zap.String("file", p), zap.Error(err))
+			report.Corrupt = append(report.Corrupt, p)
+			if clean {
+				if err := os.Remove(p); err != nil {
+					return err
+				}
+				report.Removed++
+			}
+			return nil
+		}
+		if version == 0 {
+			report.Legacy++
+		}
+		return nil
+	})
+	return report, err
+}
+
+// isCacheEntryName reports whether name looks like a diskcache key (hex encoded md5)
+func isCacheEntryName(name string) bool {
+	if len(name) != 32 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyCache is the handler of the cache verify command, it returns the exit code,
+// 2 when corrupt entries were left behind
+func verifyCache() int {
+	defer logger.Sync()
+	report, err := VerifyCacheDir(*cacheVerifyDir, *cacheVerifyClean)
+	if err != nil {
+		logger.Error(err.Error())
+		return 1
+	}
+	logger.Info("Verified cache directory",
+		zap.String("dir", *cacheVerifyDir),
+		zap.Int("checked", report.Checked),
+		zap.Int("legacy", report.Legacy),
+		zap.Int("corrupt", len(report.Corrupt)),
+		zap.Int("removed", report.Removed))
+	if len(report.Corrupt) > report.Removed {
+		return 2
+	}
+	return 0
+}
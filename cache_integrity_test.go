@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gregjones/httpcache"
+	"github.com/joomcode/errorx"
+)
+
+const testCachedResponse = "HTTP/1.1 200 OK\r\nContent-Length: 11\r\n\r\nhello world"
+
+func Test_decodeCacheEntry(t *testing.T) {
+	valid := encodeCacheEntry([]byte(testCachedResponse))
+	tampered := append([]byte{}, valid...)
+	tampered[len(tampered)-1] = 'D'
+	unsupported := append([]byte{}, valid...)
+	unsupported[len(cacheEntryMagic)] = 9
+
+	tests := []struct {
+		name        string
+		entry       []byte
+		wantVersion byte
+		wantType    *errorx.Type
+	}{
+		{name: "Valid", entry: valid, wantVersion: cacheEntryVersion},
+		{name: "Legacy", entry: []byte(testCachedResponse), wantVersion: 0},
+		{name: "Tampered", entry: tampered, wantType: CorruptCacheEntry},
+		{name: "TruncatedHeader", entry: valid[:10], wantType: CorruptCacheEntry},
+		{name: "TruncatedPayload", entry: valid[:len(valid)-3], wantType: CorruptCacheEntry},
+		{name: "Unsupported", entry: unsupported, wantType: UnsupportedCacheEntry},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, version, err := decodeCacheEntry(tt.entry)
+			if tt.wantType != nil {
+				if !errorx.IsOfType(err, tt.wantType) {
+					t.Errorf("decodeCacheEntry() error = %v, want %v", err, tt.wantType)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeCacheEntry() unexpected error = %v", err)
+			}
+			if version != tt.wantVersion {
+				t.Errorf("decodeCacheEntry() version = %d, want %d", version, tt.wantVersion)
+			}
+			if string(payload) != testCachedResponse {
+				t.Errorf("decodeCacheEntry() payload = %q", payload)
+			}
+		})
+	}
+}
+
+func TestIntegrityCache_EvictsCorrupt(t *testing.T) {
+	backing := httpcache.NewMemoryCache()
+	c := NewIntegrityCache(backing)
+	c.Set("key", []byte(testCachedResponse))
+
+	if b, ok := c.Get("key"); !ok || string(b) != testCachedResponse {
+		t.Fatalf("Get() = %q, %v", b, ok)
+	}
+
+	raw, _ := backing.Get("key")
+	backing.Set("key", raw[:len(raw)-4])
+	if _, ok := c.Get("key"); ok {
+		t.Fatal("Get() returned a corrupt entry")
+	}
+	if _, ok := backing.Get("key"); ok {
+		t.Error("corrupt entry was not evicted")
+	}
+}
+
+func TestCachedResponse_TruncatedBody(t *testing.T) {
+	c := httpcache.NewMemoryCache()
+	c.Set("key", []byte(testCachedResponse[:len(testCachedResponse)-4]))
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	if _, err := CachedResponse(c, req, "key"); err == nil {
+		t.Error("CachedResponse() expected error for truncated body")
+	}
+}
+
+func TestVerifyCacheDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	entries := map[string][]byte{
+		"00000000000000000000000000000001": encodeCacheEntry([]byte(testCachedResponse)),
+		"00000000000000000000000000000002": []byte(testCachedResponse),
+		"00000000000000000000000000000003": encodeCacheEntry([]byte(testCachedResponse))[:50],
+		"users.tmp":                        []byte("not a cache entry"),
+	}
+	for name, b := range entries {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := VerifyCacheDir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 3 || report.Legacy != 1 || len(report.Corrupt) != 1 || report.Removed != 1 {
+		t.Errorf("VerifyCacheDir() = %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "00000000000000000000000000000003")); !os.IsNotExist(err) {
+		t.Error("corrupt entry was not removed")
+	}
+}
+
+func TestVerifyCache_ExitCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	corrupt := encodeCacheEntry([]byte(testCachedResponse))[:50]
+	if err := ioutil.WriteFile(filepath.Join(dir, "00000000000000000000000000000003"), corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	savedDir, savedClean := *cacheVerifyDir, *cacheVerifyClean
+	defer func() { *cacheVerifyDir, *cacheVerifyClean = savedDir, savedClean }()
+
+	*cacheVerifyDir = dir
+	for _, tt := range []struct {
+		clean bool
+		want  int
+	}{{clean: false, want: 2}, {clean: true, want: 0}} {
+		*cacheVerifyClean = tt.clean
+		if code := verifyCache(); code != tt.want {
+			t.Errorf("verifyCache() with clean %v = %d, want %d", tt.clean, code, tt.want)
+		}
+	}
+	*cacheVerifyDir = filepath.Join(dir, "missing")
+	if code := verifyCache(); code != 1 {
+		t.Errorf("verifyCache() of a missing directory = %d, want 1", code)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/joomcode/errorx"
+	"go.uber.org/zap"
+)
+
+const redacted = "REDACTED"
+
+var (
+	cassetteNamespace = errorx.NewNamespace("cassette")
+
+	CassetteMiss    = cassetteNamespace.NewType("unmatched_request")
+	CassetteInvalid = cassetteNamespace.NewType("invalid")
+
+	// redactedParams are removed from recorded urls and used when matching on replay
+	redactedParams = []string{"api_key"}
+	// redactedHeaders are removed from recorded requests and responses
+	redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+)
+
+// CassetteInteraction is one recorded request/response pair
+type CassetteInteraction struct {
+	Request  CassetteRequest  `json:"request"`
+	Response CassetteResponse `json:"response"`
+}
+
+type CassetteRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+}
+
+type CassetteResponse struct {
+	StatusCode int         `json:"status_code"`
+	Status     string      `json:"status"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+}
+
+func (i *CassetteInteraction) key() string {
+	return i.Request.Method + " " + i.Request.URL
+}
+
+// RecordTransport passes requests through to Transport and appends every
+// request/response pair to a cassette file, one JSON object per line.
+// Lines are written as they happen so a cassette survives the process exiting early.
+type RecordTransport struct {
+	Transport http.RoundTripper
+
+	lock sync.Mutex
+	file *os.File
+}
+
+// NewRecordTransport truncates the cassette at path and records into it
+func NewRecordTransport(path string, transport http.RoundTripper) (*RecordTransport, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &RecordTransport{Transport: transport, file: f}, nil
+}
+
+func (t *RecordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	interaction := CassetteInteraction{
+		Request: CassetteRequest{
+			Method: req.Method,
+			URL:    redactURL(req.URL),
+			Header: redactHeader(req.Header),
+		},
+		Response: CassetteResponse{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Header:     redactHeader(resp.Header),
+			Body:       body,
+		},
+	}
+	if err := t.append(&interaction); err != nil {
+		logger.Error("Failed to record interaction", zap.String("url", interaction.Request.URL), zap.Error(err))
+	}
+	return resp, nil
+}
+
+func (t *RecordTransport) append(i *CassetteInteraction) error {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, err := t.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return t.file.Sync()
+}
+
+// Close closes the cassette file
+func (t *RecordTransport) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.file.Close()
+}
+
+// ReplayTransport serves responses exclusively from a cassette. Requests are
+// matched on method and redacted url; repeated requests are served in recorded
+// order and the last recording is reused once they run out. Requests with no
+// recording fail with CassetteMiss.
+type ReplayTransport struct {
+	lock         sync.Mutex
+	interactions map[string][]*CassetteInteraction
+}
+
+// NewReplayTransport loads the cassette at path
+func NewReplayTransport(path string) (*ReplayTransport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t := &ReplayTransport{interactions: make(map[string][]*CassetteInteraction)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var i CassetteInteraction
+		if err := json.Unmarshal(scanner.Bytes(), &i); err != nil {
+			return nil, CassetteInvalid.Wrap(err, fmt.Sprintf("%s line %d", path, line))
+		}
+		t.interactions[i.key()] = append(t.interactions[i.key()], &i)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := req.Method + " " + redactURL(req.URL)
+
+	t.lock.Lock()
+	recorded := t.interactions[key]
+	if len(recorded) == 0 {
+		t.lock.Unlock()
+		logger.Error("No recorded interaction for request", zap.String("request", key))
+		return nil, CassetteMiss.New(key)
+	}
+	i := recorded[0]
+	if len(recorded) > 1 {
+		t.interactions[key] = recorded[1:]
+	}
+	t.lock.Unlock()
+
+	return &http.Response{
+		Status:        i.Response.Status,
+		StatusCode:    i.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        cloneHeader(i.Response.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader(i.Response.Body)),
+		ContentLength: int64(len(i.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+// redactURL returns u with credentials replaced and the query sorted so it can be used for matching
+func redactURL(u *url.URL) string {
+	clone := *u
+	query := clone.Query()
+	for _, param := range redactedParams {
+		if _, ok := query[param]; ok {
+			query.Set(param, redacted)
+		}
+	}
+	clone.RawQuery = query.Encode()
+	clone.User = nil
+	return clone.String()
+}
+
+func redactHeader(h http.Header) http.Header {
+	clone := cloneHeader(h)
+	for key, values := range clone {
+		for _, name := range redactedHeaders {
+			if strings.EqualFold(key, name) {
+				clone[key] = []string{redacted}
+			}
+		}
+		// x-source-request carries the full request url including the api key
+		if strings.EqualFold(key, "x-source-request") {
+			for i, value := range values {
+				if u, err := url.Parse(value); err == nil {
+					values[i] = redactURL(u)
+				}
+			}
+		}
+	}
+	return clone
+}
+
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for key, values := range h {
+		clone[key] = append([]string(nil), values...)
+	}
+	return clone
+}
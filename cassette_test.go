@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/joomcode/errorx"
+)
+
+func TestCassette_RecordReplay(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Set-Cookie", "session=secret")
+		fmt.Fprintf(w, "%s call %d", r.URL.Path, calls)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "cassette")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "session.jsonl")
+
+	record, err := NewRecordTransport(path, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordClient := &http.Client{Transport: record}
+	for _, u := range []string{"/users?api_key=secret", "/leaders?page=1&api_key=secret", "/leaders?page=1&api_key=secret"} {
+		resp, err := recordClient.Get(server.URL + u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if err := record.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "secret") {
+		t.Errorf("cassette contains credentials: %s", raw)
+	}
+
+	replay, err := NewReplayTransport(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayClient := &http.Client{Transport: replay}
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "/users?api_key=other", want: "/users call 1"},
+		{url: "/leaders?api_key=other&page=1", want: "/leaders call 2"},
+		{url: "/leaders?page=1&api_key=other", want: "/leaders call 3"},
+		{url: "/leaders?page=1&api_key=other", want: "/leaders call 3"},
+	}
+	for _, tt := range tests {
+		resp, err := replayClient.Get(server.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != tt.want {
+			t.Errorf("replay %s = %q, want %q", tt.url, body, tt.want)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("replay reached the server, calls = %d", calls)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/leaders?page=2", nil)
+	if _, err := replay.RoundTrip(req); !errorx.IsOfType(err, CassetteMiss) {
+		t.Errorf("unmatched request error = %v, want CassetteMiss", err)
+	}
+}
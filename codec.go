@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/joomcode/errorx"
+	"github.com/ugorji/go/codec"
+)
+
+// codecHeaderPrefix starts the first line of every file written with a codec,
+// the codec name follows it. Files without it are legacy gob.
+const codecHeaderPrefix = "#wakatime-collector codec="
+
+var (
+	UnknownCodec = storageNamespace.NewType("unknown_codec")
+
+	codecRegistry = map[string]*Codec{}
+
+	GobCodec = RegisterCodec(&Codec{
+		Name:       "gob",
+		Extensions: []string{".gob"},
+		Encode:     GlobEncoder,
+		Decode:     GlobDecoder,
+	})
+	JSONCodec = RegisterCodec(&Codec{
+		Name:       "json",
+		Extensions: []string{".json"},
+		Encode:     JSONEncoder,
+		Decode:     JSONDecoder,
+	})
+	MsgpackCodec = RegisterCodec(&Codec{
+		Name:       "msgpack",
+		Extensions: []string{".msgpack", ".mpk"},
+		Encode:     handleEncoder(&codec.MsgpackHandle{WriteExt: true}),
+		Decode:     handleDecoder(&codec.MsgpackHandle{WriteExt: true}),
+	})
+	CBORCodec = RegisterCodec(&Codec{
+		Name:       "cbor",
+		Extensions: []string{".cbor"},
+		Encode:     handleEncoder(&codec.CborHandle{}),
+		Decode:     handleDecoder(&codec.CborHandle{}),
+	})
+)
+
+// Codec serializes state files
+type Codec struct {
+	Name       string
+	Extensions []string
+	Encode     marshaller
+	Decode     unmarshaller
+}
+
+// RegisterCodec makes c available by name and extension
+func RegisterCodec(c *Codec) *Codec {
+	codecRegistry[c.Name] = c
+	return c
+}
+
+// LookupCodec returns the registered codec called name
+func LookupCodec(name string) (*Codec, error) {
+	c, ok := codecRegistry[name]
+	if !ok {
+		return nil, UnknownCodec.New(fmt.Sprintf("%q, pick from %s", name, strings.Join(codecNames(), ", ")))
+	}
+	return c, nil
+}
+
+func codecNames() []string {
+	names := make([]string, 0, len(codecRegistry))
+	for name := range codecRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CodecForPath picks the codec registered for the extension of path,
+// falling back to the --codec flag and then gob
+func CodecForPath(path string) *Codec {
+	ext := filepath.Ext(path)
+	for _, c := range codecRegistry {
+		for _, e := range c.Extensions {
+			if strings.EqualFold(e, ext) {
+				return c
+			}
+		}
+	}
+	if storageCodec != nil {
+		if c, err := LookupCodec(*storageCodec); err == nil {
+			return c
+		}
+	}
+	return GobCodec
+}
+
+func JSONEncoder(v interface{}) (io.Reader, error) {
+	b := new(bytes.Buffer)
+	if err := json.NewEncoder(b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func JSONDecoder(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+func handleEncoder(h codec.Handle) marshaller {
+	return func(v interface{}) (io.Reader, error) {
+		b := new(bytes.Buffer)
+		if err := codec.NewEncoder(b, h).Encode(v); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+}
+
+func handleDecoder(h codec.Handle) unmarshaller {
+	return func(r io.Reader, v interface{}) error {
+		return codec.NewDecoder(r, h).Decode(v)
+	}
+}
+
+// convertFile re-encodes a state file with the codec picked by to, or the
+// extension of dst when to is empty. dst defaults to src.
+func convertFile(src, dst, to string) error {
+	if dst == "" {
+		dst = src
+	}
+	target := CodecForPath(dst)
+	if to != "" {
+		c, err := LookupCodec(to)
+		if err != nil {
+			return err
+		}
+		target = c
+	}
+
+	// files written before envelopes don't record their kind, try each one the collector writes
+	candidates := []struct {
+		kind  string
+		value func() interface{}
+	}{
+		{kind: usersStateKind, value: func() interface{} { return &map[string]bool{} }},
+		{kind: usersArrayKind, value: func() interface{} { return &[]string{} }},
+	}
+	var lastErr error
+	for _, candidate := range candidates {
+		v := candidate.value()
+		if _, err := LoadState(src, candidate.kind, v); err != nil {
+			lastErr = err
+			continue
+		}
+		return writeAtomically(dst, func(w io.Writer) error {
+			return SaveState(w, candidate.kind, v, target)
+		})
+	}
+	return errorx.Decorate(lastErr, "unable to decode "+src)
+}
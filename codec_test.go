@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	state := map[string]bool{"a": true, "b": false}
+	ids := []string{"a", "b"}
+	for _, name := range codecNames() {
+		t.Run(name, func(t *testing.T) {
+			c, err := LookupCodec(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range []interface{}{state, ids} {
+				r, err := c.Encode(want)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := reflect.New(reflect.TypeOf(want))
+				if err := c.Decode(r, got.Interface()); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got.Elem().Interface(), want) {
+					t.Errorf("round trip = %v, want %v", got.Elem().Interface(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestCodecForPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want *Codec
+	}{
+		{path: "users.json", want: JSONCodec},
+		{path: "users.CBOR", want: CBORCodec},
+		{path: "users.mpk", want: MsgpackCodec},
+		{path: "allusers.array", want: GobCodec},
+	}
+	for _, tt := range tests {
+		if got := CodecForPath(tt.path); got != tt.want {
+			t.Errorf("CodecForPath(%q) = %s, want %s", tt.path, got.Name, tt.want.Name)
+		}
+	}
+}
+
+func TestConvertFile_Legacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a bare gob file as written before codec headers
+	legacy := filepath.Join(dir, "allusers.array")
+	r, err := GlobEncoder([]string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(f, r)
+	f.Close()
+
+	converted := filepath.Join(dir, "allusers.json")
+	if err := convertFile(legacy, converted, ""); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(converted)
+	if !strings.HasPrefix(string(b), codecHeaderPrefix+"json\n"+schemaHeaderPrefix+`{"kind":"users-array"`) || !strings.Contains(string(b), `["a","b"]`) {
+		t.Errorf("converted file = %q", b)
+	}
+
+	if err := convertFile(converted, legacy, "cbor"); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	if _, err := LoadState(legacy, usersArrayKind, &ids); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"a", "b"}) {
+		t.Errorf("Load() after converting to cbor = %v", ids)
+	}
+}
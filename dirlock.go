@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"go.uber.org/zap"
+)
+
+const lockFileName = ".collector.lock"
+
+var (
+	lockNamespace = errorx.NewNamespace("lock")
+
+	DirLocked = lockNamespace.NewType("locked")
+	LockLost  = lockNamespace.NewType("lost")
+)
+
+// LockInfo is written to the lock file to identify its holder
+type LockInfo struct {
+	PID       int       `json:"pid"`
+	Hostname  string    `json:"hostname"`
+	Token     string    `json:"token"`
+	Version   string    `json:"version"`
+	Started   time.Time `json:"started"`
+	Heartbeat time.Time `json:"heartbeat"`
+}
+
+// stale reports whether the holder of the lock is gone, either because its
+// heartbeat stopped or because it ran on this host and the process has exited.
+func (i *LockInfo) stale(hostname string, staleAfter time.Duration) bool {
+	if time.Since(i.Heartbeat) > staleAfter {
+		return true
+	}
+	return i.Hostname == hostname && !processAlive(i.PID)
+}
+
+// DirLock is an advisory lock on a data directory shared by collector processes.
+// The holder refreshes the heartbeat in the lock file until it is released.
+type DirLock struct {
+	path       string
+	staleAfter time.Duration
+
+	lock sync.Mutex
+	info LockInfo
+	quit chan struct{}
+	done chan struct{}
+	lost chan struct{}
+}
+
+// AcquireDirLock locks dir, taking over a lock whose holder is stale.
+// The returned error is of type DirLocked when another live process holds it.
+func AcquireDirLock(dir string, staleAfter time.Duration) (*DirLock, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	l := &DirLock{
+		path:       filepath.Join(dir, lockFileName),
+		staleAfter: staleAfter,
+		info: LockInfo{
+			PID:       os.Getpid(),
+			Hostname:  hostname,
+			Token:     hex.EncodeToString(token),
+			Version:   GitSummary,
+			Started:   now,
+			Heartbeat: now,
+		},
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		err := l.create()
+		if err == nil {
+			l.quit = make(chan struct{})
+			l.done = make(chan struct{})
+			l.lost = make(chan struct{})
+			go l.heartbeat(l.quit)
+			return l, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		holder, err := readLockInfo(l.path)
+		if err != nil {
+			return nil, err
+		}
+		if !holder.stale(hostname, staleAfter) {
+			return nil, DirLocked.New(fmt.Sprintf("%s is held by pid %d on %s since %s",
+				l.path, holder.PID, holder.Hostname, holder.Started.Format(time.RFC3339)))
+		}
+		logger.Warn("Taking over stale lock", zap.String("file", l.path), zap.Int("pid", holder.PID),
+			zap.String("host", holder.Hostname), zap.Time("heartbeat", holder.Heartbeat))
+		if err := removeStaleLock(l.path, holder); err != nil {
+			return nil, err
+		}
+	}
+	return nil, DirLocked.New(fmt.Sprintf("%s was taken by another process", l.path))
+}
+
+// WaitDirLock retries AcquireDirLock every poll interval until it succeeds or ctx is done
+func WaitDirLock(ctx context.Context, dir string, staleAfter, poll time.Duration) (*DirLock, error) {
+	logged := false
+	for {
+		l, err := AcquireDirLock(dir, staleAfter)
+		if err == nil || !errorx.IsOfType(err, DirLocked) {
+			return l, err
+		}
+		if !logged {
+			logger.Info("Waiting for lock", zap.Error(err))
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(poll):
+		}
+	}
+}
+
+func (l *DirLock) create() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(l.info)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(l.path)
+	}
+	return err
+}
+
+// removeStaleLock moves the lock aside before deleting it so that only one
+// process can take it over. If the lock changed hands in the meantime it is put back.
+func removeStaleLock(path string, holder *LockInfo) error {
+	aside := fmt.Sprintf("%s.stale-%d", path, os.Getpid())
+	if err := os.Rename(path, aside); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	moved, err := readLockInfo(aside)
+	if err == nil && moved.Token != holder.Token {
+		return os.Rename(aside, path)
+	}
+	return os.Remove(aside)
+}
+
+func readLockInfo(path string) (*LockInfo, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	info := &LockInfo{}
+	if err := json.Unmarshal(b, info); err != nil {
+		// the lock is being written or was left behind by a crash while it was,
+		// fall back to the modification time so it only goes stale by age
+		stat, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		return &LockInfo{Heartbeat: stat.ModTime()}, nil
+	}
+	return info, nil
+}
+
+func (l *DirLock) heartbeat(quit chan struct{}) {
+	defer close(l.done)
+	ticker := time.NewTicker(l.staleAfter / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := l.refresh()
+			if errorx.IsOfType(err, LockLost) {
+				close(l.lost)
+				return
+			}
+			if err != nil {
+				logger.Error("Failed to refresh lock", zap.String("file", l.path), zap.Error(err))
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Lost is closed when another process took the lock, the holder must stop writing to the directory
+func (l *DirLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// refresh rewrites the heartbeat, failing with LockLost if another process took the lock
+func (l *DirLock) refresh() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	holder, err := readLockInfo(l.path)
+	if err != nil {
+		return err
+	}
+	if holder.Token != l.info.Token {
+		return LockLost.New(fmt.Sprintf("%s is now held by pid %d on %s", l.path, holder.PID, holder.Hostname))
+	}
+	l.info.Heartbeat = time.Now()
+	return writeAtomically(l.path, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(l.info)
+	})
+}
+
+// Release stops the heartbeat and removes the lock file if it is still ours
+func (l *DirLock) Release() error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	quit := l.quit
+	l.quit = nil
+	l.lock.Unlock()
+	if quit == nil {
+		return nil
+	}
+	close(quit)
+	<-l.done
+
+	holder, err := readLockInfo(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if holder.Token != l.info.Token {
+		return nil
+	}
+	return os.Remove(l.path)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+func writeTestLock(t *testing.T, dir string, info LockInfo) {
+	b, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, lockFileName), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirLock_Exclusive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first, err := AcquireDirLock(dir, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AcquireDirLock(dir, time.Minute); !errorx.IsOfType(err, DirLocked) {
+		t.Fatalf("second AcquireDirLock() error = %v, want DirLocked", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		first.Release()
+	}()
+	second, err := WaitDirLock(ctx, dir, time.Minute, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("WaitDirLock() error = %v", err)
+	}
+	if err := second.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, lockFileName)); !os.IsNotExist(err) {
+		t.Error("Release() left the lock file behind")
+	}
+}
+
+func TestDirLock_TakesOverStale(t *testing.T) {
+	hostname, _ := os.Hostname()
+	tests := []struct {
+		name      string
+		holder    LockInfo
+		wantTaken bool
+	}{
+		{name: "Live", holder: LockInfo{PID: os.Getpid(), Hostname: hostname, Token: "a", Heartbeat: time.Now()}},
+		{name: "OtherHost", holder: LockInfo{PID: 1 << 30, Hostname: "elsewhere", Token: "a", Heartbeat: time.Now()}},
+		{name: "ExpiredHeartbeat", holder: LockInfo{PID: os.Getpid(), Hostname: "elsewhere", Token: "a", Heartbeat: time.Now().Add(-time.Hour)}, wantTaken: true},
+		{name: "DeadProcess", holder: LockInfo{PID: 1 << 30, Hostname: hostname, Token: "a", Heartbeat: time.Now()}, wantTaken: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "dirlock")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			writeTestLock(t, dir, tt.holder)
+
+			l, err := AcquireDirLock(dir, time.Minute)
+			if tt.wantTaken {
+				if err != nil {
+					t.Fatalf("AcquireDirLock() error = %v", err)
+				}
+				l.Release()
+				return
+			}
+			if !errorx.IsOfType(err, DirLocked) {
+				t.Errorf("AcquireDirLock() error = %v, want DirLocked", err)
+			}
+		})
+	}
+}
+
+func TestDirLock_RefreshDetectsLoss(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := AcquireDirLock(dir, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.refresh(); err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	writeTestLock(t, dir, LockInfo{PID: 1, Hostname: "elsewhere", Token: "other", Heartbeat: time.Now()})
+	if err := l.refresh(); !errorx.IsOfType(err, LockLost) {
+		t.Errorf("refresh() error = %v, want LockLost", err)
+	}
+	l.Release()
+	if _, err := os.Stat(filepath.Join(dir, lockFileName)); err != nil {
+		t.Error("Release() removed a lock held by another process")
+	}
+}
+
+func TestDirLock_LostStopsHeartbeat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := AcquireDirLock(dir, 40*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Release()
+	writeTestLock(t, dir, LockInfo{PID: 1, Hostname: "elsewhere", Token: "other", Heartbeat: time.Now()})
+	select {
+	case <-l.Lost():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lost() wasn't closed after another process took the lock")
+	}
+}
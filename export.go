@@ -0,0 +1,300 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/joomcode/errorx"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// parquetRowGroupSize bounds how many bytes of rows are buffered before a row group is written
+const parquetRowGroupSize = 16 * 1024 * 1024
+
+// exportRow is one row of an exported table, its struct tags name the json and parquet columns
+type exportRow interface {
+	Header() []string
+	Record() []string
+}
+
+// exportQuery selects the rows of one table, the query takes the snapshot date and range as arguments
+type exportQuery struct {
+	query  string
+	newRow func() exportRow
+	scan   func(rows *sql.Rows) (exportRow, error)
+}
+
+// exportFilter narrows each query to a snapshot date and range when they are not empty
+const exportFilter = ` (? = '' OR r.snapshot_date = ?) AND (? = '' OR r.range_name = ?) `
+
+var exportTables = map[string]exportQuery{
+	"users": {
+		query: `SELECT r.snapshot_date, r.range_name, s.run_id, s.user_id, COALESCE(u.username, ''), COALESCE(l.rank, 0),
+				COALESCE(s.total_seconds, 0), COALESCE(s.daily_average, 0),
+				COALESCE((SELECT name FROM stat_breakdowns b WHERE b.run_id = s.run_id AND b.user_id = s.user_id AND b.category = 'language' ORDER BY total_seconds DESC LIMIT 1), ''),
+				COALESCE((SELECT name FROM stat_breakdowns b WHERE b.run_id = s.run_id AND b.user_id = s.user_id AND b.category = 'editor' ORDER BY total_seconds DESC LIMIT 1), ''),
+				COALESCE((SELECT name FROM stat_breakdowns b WHERE b.run_id = s.run_id AND b.user_id = s.user_id AND b.category = 'operating_system' ORDER BY total_seconds DESC LIMIT 1), '')
+			FROM user_stats s
+			JOIN runs r ON r.id = s.run_id
+			LEFT JOIN users u ON u.id = s.user_id
+			LEFT JOIN leaderboard_snapshots l ON l.run_id = s.run_id AND l.user_id = s.user_id
+			WHERE` + exportFilter + `ORDER BY s.run_id, l.rank`,
+		newRow: func() exportRow { return new(userExportRow) },
+		scan: func(rows *sql.Rows) (exportRow, error) {
+			r := new(userExportRow)
+			return r, rows.Scan(&r.Date, &r.Range, &r.RunID, &r.UserID, &r.Username, &r.Rank, &r.TotalSeconds,
+				&r.DailyAverage, &r.TopLanguage, &r.TopEditor, &r.TopOperatingSystem)
+		},
+	},
+	"languages": {
+		query: `SELECT r.snapshot_date, r.range_name, b.run_id, b.user_id, COALESCE(u.username, ''), b.name,
+				COALESCE(b.total_seconds, 0), COALESCE(b.percent, 0)
+			FROM stat_breakdowns b
+			JOIN runs r ON r.id = b.run_id
+			LEFT JOIN users u ON u.id = b.user_id
+			WHERE b.category = 'language' AND` + exportFilter + `ORDER BY b.run_id, b.user_id, b.total_seconds DESC`,
+		newRow: func() exportRow { return new(languageExportRow) },
+		scan: func(rows *sql.Rows) (exportRow, error) {
+			r := new(languageExportRow)
+			return r, rows.Scan(&r.Date, &r.Range, &r.RunID, &r.UserID, &r.Username, &r.Language, &r.TotalSeconds, &r.Percent)
+		},
+	},
+	"leaderboard": {
+		query: `SELECT r.snapshot_date, r.range_name, l.run_id, l.page, l.rank, l.user_id, COALESCE(u.username, ''),
+				COALESCE(l.total_seconds, 0), COALESCE(l.daily_average, 0)
+			FROM leaderboard_snapshots l
+			JOIN runs r ON r.id = l.run_id
+			LEFT JOIN users u ON u.id = l.user_id
+			WHERE` + exportFilter + `ORDER BY l.run_id, l.rank`,
+		newRow: func() exportRow { return new(leaderboardExportRow) },
+		scan: func(rows *sql.Rows) (exportRow, error) {
+			r := new(leaderboardExportRow)
+			return r, rows.Scan(&r.Date, &r.Range, &r.RunID, &r.Page, &r.Rank, &r.UserID, &r.Username, &r.TotalSeconds, &r.DailyAverage)
+		},
+	},
+}
+
+// userExportRow summarises the stats of one user in one run
+type userExportRow struct {
+	Date               string  `json:"date" parquet:"name=date, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Range              string  `json:"range" parquet:"name=range, type=BYTE_ARRAY, convertedtype=UTF8"`
+	RunID              int64   `json:"run_id" parquet:"name=run_id, type=INT64"`
+	UserID             string  `json:"user_id" parquet:"name=user_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Username           string  `json:"username" parquet:"name=username, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Rank               int64   `json:"rank" parquet:"name=rank, type=INT64"`
+	TotalSeconds       float64 `json:"total_seconds" parquet:"name=total_seconds, type=DOUBLE"`
+	DailyAverage       int64   `json:"daily_average" parquet:"name=daily_average, type=INT64"`
+	TopLanguage        string  `json:"top_language" parquet:"name=top_language, type=BYTE_ARRAY, convertedtype=UTF8"`
+	TopEditor          string  `json:"top_editor" parquet:"name=top_editor, type=BYTE_ARRAY, convertedtype=UTF8"`
+	TopOperatingSystem string  `json:"top_operating_system" parquet:"name=top_operating_system, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+func (r *userExportRow) Header() []string {
+	return []string{"date", "range", "run_id", "user_id", "username", "rank", "total_seconds", "daily_average",
+		"top_language", "top_editor", "top_operating_system"}
+}
+
+func (r *userExportRow) Record() []string {
+	return []string{r.Date, r.Range, formatInt(r.RunID), r.UserID, r.Username, formatInt(r.Rank), formatFloat(r.TotalSeconds),
+		formatInt(r.DailyAverage), r.TopLanguage, r.TopEditor, r.TopOperatingSystem}
+}
+
+// languageExportRow is the time one user spent in one language during a run
+type languageExportRow struct {
+	Date         string  `json:"date" parquet:"name=date, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Range        string  `json:"range" parquet:"name=range, type=BYTE_ARRAY, convertedtype=UTF8"`
+	RunID        int64   `json:"run_id" parquet:"name=run_id, type=INT64"`
+	UserID       string  `json:"user_id" parquet:"name=user_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Username     string  `json:"username" parquet:"name=username, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Language     string  `json:"language" parquet:"name=language, type=BYTE_ARRAY, convertedtype=UTF8"`
+	TotalSeconds float64 `json:"total_seconds" parquet:"name=total_seconds, type=DOUBLE"`
+	Percent      float64 `json:"percent" parquet:"name=percent, type=DOUBLE"`
+}
+
+func (r *languageExportRow) Header() []string {
+	return []string{"date", "range", "run_id", "user_id", "username", "language", "total_seconds", "percent"}
+}
+
+func (r *languageExportRow) Record() []string {
+	return []string{r.Date, r.Range, formatInt(r.RunID), r.UserID, r.Username, r.Language, formatFloat(r.TotalSeconds), formatFloat(r.Percent)}
+}
+
+// leaderboardExportRow is one rank of a leader board snapshot
+type leaderboardExportRow struct {
+	Date         string  `json:"date" parquet:"name=date, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Range        string  `json:"range" parquet:"name=range, type=BYTE_ARRAY, convertedtype=UTF8"`
+	RunID        int64   `json:"run_id" parquet:"name=run_id, type=INT64"`
+	Page         int64   `json:"page" parquet:"name=page, type=INT64"`
+	Rank         int64   `json:"rank" parquet:"name=rank, type=INT64"`
+	UserID       string  `json:"user_id" parquet:"name=user_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Username     string  `json:"username" parquet:"name=username, type=BYTE_ARRAY, convertedtype=UTF8"`
+	TotalSeconds float64 `json:"total_seconds" parquet:"name=total_seconds, type=DOUBLE"`
+	DailyAverage int64   `json:"daily_average" parquet:"name=daily_average, type=INT64"`
+}
+
+func (r *leaderboardExportRow) Header() []string {
+	return []string{"date", "range", "run_id", "page", "rank", "user_id", "username", "total_seconds", "daily_average"}
+}
+
+func (r *leaderboardExportRow) Record() []string {
+	return []string{r.Date, r.Range, formatInt(r.RunID), formatInt(r.Page), formatInt(r.Rank), r.UserID, r.Username,
+		formatFloat(r.TotalSeconds), formatInt(r.DailyAverage)}
+}
+
+func formatInt(i int64) string {
+	return strconv.FormatInt(i, 10)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// exportWriter streams rows in one format
+type exportWriter interface {
+	Write(row exportRow) error
+	Close() error
+}
+
+type csvExportWriter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+func (c *csvExportWriter) Write(row exportRow) error {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		if err := c.w.Write(row.Header()); err != nil {
+			return err
+		}
+	}
+	return c.w.Write(row.Record())
+}
+
+func (c *csvExportWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type jsonlExportWriter struct {
+	e *json.Encoder
+}
+
+func (j *jsonlExportWriter) Write(row exportRow) error {
+	return j.e.Encode(row)
+}
+
+func (j *jsonlExportWriter) Close() error {
+	return nil
+}
+
+type parquetExportWriter struct {
+	pw *writer.ParquetWriter
+}
+
+func (p *parquetExportWriter) Write(row exportRow) error {
+	return p.pw.Write(row)
+}
+
+func (p *parquetExportWriter) Close() error {
+	return p.pw.WriteStop()
+}
+
+// newExportWriter returns a writer of format for rows shaped like sample
+func newExportWriter(w io.Writer, format string, sample exportRow) (exportWriter, error) {
+	switch format {
+	case "csv":
+		return &csvExportWriter{w: csv.NewWriter(w)}, nil
+	case "jsonl":
+		return &jsonlExportWriter{e: json.NewEncoder(w)}, nil
+	case "parquet":
+		pw, err := writer.NewParquetWriterFromWriter(w, sample, 1)
+		if err != nil {
+			return nil, err
+		}
+		pw.RowGroupSize = parquetRowGroupSize
+		pw.CompressionType = parquet.CompressionCodec_SNAPPY
+		return &parquetExportWriter{pw: pw}, nil
+	}
+	return nil, errorx.IllegalArgument.New(fmt.Sprintf("unknown export format %q", format))
+}
+
+// Export streams table for the snapshot date and range, either may be empty for all of them.
+// It returns the number of rows written.
+func (s *Store) Export(w io.Writer, table, format, date, rangeName string) (int, error) {
+	t, ok := exportTables[table]
+	if !ok {
+		return 0, errorx.IllegalArgument.New(fmt.Sprintf("%q, pick from %s", table, strings.Join(exportTableNames(), ", ")))
+	}
+	out, err := newExportWriter(w, format, t.newRow())
+	if err != nil {
+		return 0, err
+	}
+	rows, err := s.db.Query(t.query, date, date, rangeName, rangeName)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		row, err := t.scan(rows)
+		if err != nil {
+			return count, err
+		}
+		if err := out.Write(row); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	return count, out.Close()
+}
+
+func exportTableNames() []string {
+	return []string{"users", "languages", "leaderboard"}
+}
+
+// export is the handler of the export command
+func export() (rerr error) {
+	if *databaseFile == "" {
+		return errorx.IllegalArgument.New("export reads the --database, it can't be empty")
+	}
+	s, err := OpenStore(*databaseFile)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	var w io.Writer = os.Stdout
+	if *exportOutput != "" && *exportOutput != "-" {
+		f, err := os.Create(*exportOutput)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := f.Close(); err != nil && rerr == nil {
+				rerr = err
+			}
+		}()
+		w = f
+	}
+	rangeName := ""
+	if *exportRange != "" {
+		days, _ := strconv.Atoi(*exportRange)
+		rangeName = rangeLeaderBoardString(days)
+	}
+	count, err := s.Export(w, *exportTable, *exportFormat, *exportDate, rangeName)
+	if err != nil {
+		return errorx.Decorate(err, "export of %s failed after %d rows", *exportTable, count)
+	}
+	logger.Debug(fmt.Sprintf("Exported %d rows of %s", count, *exportTable))
+	return nil
+}
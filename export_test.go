@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStore_Export(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := OpenStore(filepath.Join(dir, "wakatime.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	recordTestRun(t, s, time.Date(2019, 1, 1, 12, 0, 0, 0, time.Local))
+	recordTestRun(t, s, time.Date(2019, 1, 2, 12, 0, 0, 0, time.Local))
+
+	tests := []struct {
+		table, format, date string
+		rows                int
+	}{
+		{table: "users", format: "csv", rows: 2},
+		{table: "users", format: "csv", date: "2019-01-02", rows: 1},
+		{table: "languages", format: "jsonl", date: "2019-01-01", rows: 2},
+		{table: "leaderboard", format: "jsonl", rows: 4},
+		{table: "languages", format: "parquet", rows: 4},
+	}
+	for _, tt := range tests {
+		b := new(bytes.Buffer)
+		count, err := s.Export(b, tt.table, tt.format, tt.date, "")
+		if err != nil {
+			t.Fatalf("Export(%s, %s): %v", tt.table, tt.format, err)
+		}
+		if count != tt.rows {
+			t.Errorf("Export(%s, %s, %q) wrote %d rows, want %d", tt.table, tt.format, tt.date, count, tt.rows)
+		}
+		switch tt.format {
+		case "csv":
+			records, err := csv.NewReader(b).ReadAll()
+			if err != nil || len(records) != tt.rows+1 {
+				t.Errorf("csv has %d records, %v", len(records), err)
+			}
+		case "jsonl":
+			lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+			var row map[string]interface{}
+			if err := json.Unmarshal([]byte(lines[0]), &row); err != nil || row["user_id"] != "a" {
+				t.Errorf("first jsonl row = %v, %v", row, err)
+			}
+		case "parquet":
+			if !bytes.HasPrefix(b.Bytes(), []byte("PAR1")) || !bytes.HasSuffix(b.Bytes(), []byte("PAR1")) {
+				t.Errorf("parquet output is missing its magic")
+			}
+		}
+	}
+
+	b := new(bytes.Buffer)
+	s.Export(b, "users", "csv", "", "")
+	records, _ := csv.NewReader(b).ReadAll()
+	if got := strings.Join(records[1], ","); !strings.HasPrefix(got, "2019-01-01,last_7_days,1,a,alice,1,3600,0,Go,Vim,Linux") {
+		t.Errorf("first users row = %s", got)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+const harVersion = "1.2"
+
+// HAR is the root of an HTTP Archive 1.2 document
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string      `json:"version"`
+	Creator HARCreator  `json:"creator"`
+	Entries []*HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+	// FromCache is set when the response was served by the cache rather than the network
+	FromCache bool `json:"_fromCache"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// HARTimings are in milliseconds, -1 when the phase does not apply
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harTrailer closes the entries array and the document after the last entry
+const harTrailer = "\n]}}\n"
+
+// HARTransport records all traffic passing through Transport as HAR entries.
+// Wrap the caching Transport with it so cache hits are recorded as well.
+// Entries are written to the file as they complete, each one followed by the
+// trailer so the file is a complete HAR document however the process ends.
+type HARTransport struct {
+	Transport http.RoundTripper
+
+	lock    sync.Mutex
+	file    *os.File
+	entries int
+	// end is where the trailer starts, the next entry overwrites it
+	end int64
+}
+
+// NewHARTransport truncates the HAR file at path and starts a document with no entries
+func NewHARTransport(path string, transport http.RoundTripper) (*HARTransport, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	creator, err := json.Marshal(HARCreator{Name: "wakatime-collector", Version: GitSummary})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	head := fmt.Sprintf(`{"log": {"version": %q, "creator": %s, "entries": [`, harVersion, creator)
+	if _, err := f.WriteString(head + harTrailer); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &HARTransport{Transport: transport, file: f, end: int64(len(head))}, nil
+}
+
+// harTrace collects the connection phase timestamps of a single request
+type harTrace struct {
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	gotConn, wroteRequest     time.Time
+	firstByte                 time.Time
+}
+
+func (h *harTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { h.dnsStart = time.Now() },
+		DNSDone:              func(httptrace.DNSDoneInfo) { h.dnsDone = time.Now() },
+		ConnectStart:         func(string, string) { h.connectStart = time.Now() },
+		ConnectDone:          func(string, string, error) { h.connectDone = time.Now() },
+		TLSHandshakeStart:    func() { h.tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { h.tlsDone = time.Now() },
+		GotConn:              func(httptrace.GotConnInfo) { h.gotConn = time.Now() },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { h.wroteRequest = time.Now() },
+		GotFirstResponseByte: func() { h.firstByte = time.Now() },
+	}
+}
+
+func (t *HARTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	trace := &harTrace{}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace()))
+
+	start := time.Now()
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	end := time.Now()
+
+	entry := &HAREntry{
+		StartedDateTime: start.Format(time.RFC3339Nano),
+		Time:            milliseconds(start, end),
+		Request:         harRequest(req),
+		Response:        harResponse(resp, body),
+		Timings:         trace.timings(start, end),
+		FromCache:       resp.Header.Get(XFromCache) != "",
+	}
+	if entry.FromCache {
+		entry.Comment = "served from cache"
+	}
+
+	if err := t.write(entry); err != nil {
+		logger.Error("Failed to write HAR entry", zap.String("file", t.file.Name()), zap.Error(err))
+	}
+	return resp, nil
+}
+
+// write puts entry where the trailer was and the trailer after it
+func (t *HARTransport) write(entry *HAREntry) error {
+	b, err := json.MarshalIndent(entry, "  ", "  ")
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.file == nil {
+		return os.ErrClosed
+	}
+	separator := "\n  "
+	if t.entries > 0 {
+		separator = ",\n  "
+	}
+	record := append([]byte(separator), b...)
+	if _, err := t.file.WriteAt(append(record, harTrailer...), t.end); err != nil {
+		return err
+	}
+	t.end += int64(len(record))
+	t.entries++
+	return nil
+}
+
+// Close closes the HAR file, it holds every entry recorded until now
+func (t *HARTransport) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
+
+func (h *harTrace) timings(start, end time.Time) HARTimings {
+	timings := HARTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1}
+	if h.gotConn.IsZero() {
+		// no connection was made, the response came from the cache
+		return timings
+	}
+	if !h.dnsStart.IsZero() && !h.dnsDone.IsZero() {
+		timings.DNS = milliseconds(h.dnsStart, h.dnsDone)
+	}
+	if !h.connectStart.IsZero() && !h.connectDone.IsZero() {
+		timings.Connect = milliseconds(h.connectStart, h.connectDone)
+	}
+	if !h.tlsStart.IsZero() && !h.tlsDone.IsZero() {
+		timings.SSL = milliseconds(h.tlsStart, h.tlsDone)
+	}
+	timings.Blocked = milliseconds(start, h.gotConn) - nonNegative(timings.DNS) - nonNegative(timings.Connect)
+	if timings.Blocked < 0 {
+		timings.Blocked = 0
+	}
+	if !h.wroteRequest.IsZero() {
+		timings.Send = milliseconds(h.gotConn, h.wroteRequest)
+		if !h.firstByte.IsZero() {
+			timings.Wait = milliseconds(h.wroteRequest, h.firstByte)
+			timings.Receive = milliseconds(h.firstByte, end)
+		}
+	}
+	return timings
+}
+
+func harRequest(req *http.Request) HARRequest {
+	u := redactURL(req.URL)
+	query := []HARNameValue{}
+	if parsed, err := url.Parse(u); err == nil {
+		for name, values := range parsed.Query() {
+			for _, value := range values {
+				query = append(query, HARNameValue{Name: name, Value: value})
+			}
+		}
+	}
+	bodySize := req.ContentLength
+	if req.Body == nil {
+		bodySize = 0
+	}
+	return HARRequest{
+		Method:      req.Method,
+		URL:         u,
+		HTTPVersion: protoOrDefault(req.Proto),
+		Cookies:     []HARNameValue{},
+		Headers:     harHeaders(redactHeader(req.Header)),
+		QueryString: query,
+		HeadersSize: -1,
+		BodySize:    bodySize,
+	}
+}
+
+func harResponse(resp *http.Response, body []byte) HARResponse {
+	mimeType := resp.Header.Get("Content-Type")
+	content := HARContent{Size: int64(len(body)), MimeType: mimeType}
+	if isTextual(mimeType) && utf8.Valid(body) {
+		content.Text = string(body)
+	} else if len(body) > 0 {
+		content.Text = base64.StdEncoding.EncodeToString(body)
+		content.Encoding = "base64"
+	}
+	statusText := http.StatusText(resp.StatusCode)
+	if len(resp.Status) > 4 {
+		statusText = resp.Status[4:]
+	}
+	return HARResponse{
+		Status:      resp.StatusCode,
+		StatusText:  statusText,
+		HTTPVersion: protoOrDefault(resp.Proto),
+		Cookies:     []HARNameValue{},
+		Headers:     harHeaders(redactHeader(resp.Header)),
+		Content:     content,
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    int64(len(body)),
+	}
+}
+
+func harHeaders(h http.Header) []HARNameValue {
+	headers := []HARNameValue{}
+	for name, values := range h {
+		for _, value := range values {
+			headers = append(headers, HARNameValue{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+func isTextual(mimeType string) bool {
+	if mimeType == "" {
+		return true
+	}
+	media, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(media, "text/") || strings.HasSuffix(media, "json") || strings.HasSuffix(media, "xml")
+}
+
+func protoOrDefault(proto string) string {
+	if proto == "" {
+		return "HTTP/1.1"
+	}
+	return proto
+}
+
+func milliseconds(from, to time.Time) float64 {
+	return float64(to.Sub(from)) / float64(time.Millisecond)
+}
+
+func nonNegative(v float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gregjones/httpcache"
+)
+
+func TestHARTransport_RecordsCacheHits(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"data":[]}`)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "har")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "traffic.har")
+
+	recorder, err := NewHARTransport(file, NewHeuristicTransport(httpcache.NewMemoryCache()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: recorder}
+	var doc HAR
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL + "/leaders?api_key=secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		// the file is a complete document after every entry, not only once closed
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(raw, []byte("secret")) {
+			t.Error("HAR contains credentials")
+		}
+		doc = HAR{}
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			t.Fatalf("HAR after %d entries isn't valid: %v", i+1, err)
+		}
+		if doc.Log.Version != harVersion || len(doc.Log.Entries) != i+1 {
+			t.Fatalf("unexpected HAR log: version %q, %d entries", doc.Log.Version, len(doc.Log.Entries))
+		}
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	first, second := doc.Log.Entries[0], doc.Log.Entries[1]
+	if first.FromCache || !second.FromCache {
+		t.Errorf("FromCache = %v, %v; want false, true", first.FromCache, second.FromCache)
+	}
+	if second.Timings.Connect != -1 {
+		t.Errorf("cache hit connect timing = %v, want -1", second.Timings.Connect)
+	}
+	if first.Response.Status != 200 || first.Response.Content.Text != `{"data":[]}` {
+		t.Errorf("unexpected response entry %+v", first.Response)
+	}
+}
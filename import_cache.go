@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/peterbourgon/diskv"
+	"go.uber.org/zap"
+
+	userclient "github.com/will7200/go-wakatime/client/user"
+	"github.com/will7200/go-wakatime/models"
+)
+
+// cacheDirPrefix names the cache directory of each day, the snapshot date follows it
+const cacheDirPrefix = ".cache-"
+
+// diskvKeyCache is a read only Cache addressing entries by their diskv key rather than the
+// request they were stored for, so entries can be read back without knowing the request.
+// Writes are dropped so importing never alters the caches being imported.
+type diskvKeyCache struct {
+	d *diskv.Diskv
+}
+
+func (c *diskvKeyCache) Get(key string) ([]byte, bool) {
+	b, err := c.d.Read(key)
+	return b, err == nil
+}
+
+func (c *diskvKeyCache) Set(key string, responseBytes []byte) {}
+
+func (c *diskvKeyCache) Delete(key string) {}
+
+// CacheImportReport summarises the responses found in the cache directories
+type CacheImportReport struct {
+	Leaderboards int
+	Stats        int
+	Skipped      int
+	Unreadable   int
+}
+
+// ImportCacheDir backfills s from dir, a .cache-YYYY-MM-DD directory holding one cache per range
+func ImportCacheDir(s *Store, dir string, report *CacheImportReport) error {
+	day, err := time.ParseInLocation(snapshotDateFormat, strings.TrimPrefix(filepath.Base(dir), cacheDirPrefix), time.Local)
+	if err != nil {
+		return errorx.IllegalArgument.Wrap(err, dir+" isn't named "+cacheDirPrefix+snapshotDateFormat)
+	}
+	ranges, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, r := range ranges {
+		if !r.IsDir() {
+			continue
+		}
+		if err := importRangeCache(s, filepath.Join(dir, r.Name()), r.Name(), day, report); err != nil {
+			return errorx.Decorate(err, "import of %s failed", filepath.Join(dir, r.Name()))
+		}
+	}
+	return nil
+}
+
+func importRangeCache(s *Store, dir, rangeName string, day time.Time, report *CacheImportReport) error {
+	d := diskv.New(diskv.Options{BasePath: dir})
+	cache := NewIntegrityCache(&diskvKeyCache{d: d})
+	runID, err := s.ImportRun(rangeName, day)
+	if err != nil {
+		return err
+	}
+	for key := range d.Keys(nil) {
+		if !isCacheEntryName(key) {
+			continue
+		}
+		b, ok := cache.Get(key)
+		if !ok {
+			logger.Warn("Skipping unreadable cache entry", zap.String("file", filepath.Join(dir, key)))
+			report.Unreadable++
+			continue
+		}
+		if err := importCachedResponse(s, runID, rangeName, day, b, report); err != nil {
+			logger.Warn("Skipping cache entry", zap.String("file", filepath.Join(dir, key)), zap.Error(err))
+			report.Unreadable++
+		}
+	}
+	return nil
+}
+
+// importCachedResponse stores one dumped response, the request it answered is in its x-source-request header
+func importCachedResponse(s *Store, runID int64, rangeName string, day time.Time, b []byte, report *CacheImportReport) error {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	source, err := url.Parse(resp.Header.Get("x-source-request"))
+	if err != nil || source.Path == "" {
+		report.Skipped++
+		return nil
+	}
+	fetched := day
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		fetched = date
+	}
+
+	parts := strings.Split(strings.Trim(source.Path, "/"), "/")
+	switch {
+	case len(parts) > 0 && parts[len(parts)-1] == "leaders":
+		page := new(models.Leaders)
+		if err := json.NewDecoder(resp.Body).Decode(page); err != nil {
+			return err
+		}
+		report.Leaderboards++
+		return s.SaveLeaderboardPage(runID, rangeName, page, fetched)
+	case statsUser(parts) != "":
+		user := statsUser(parts)
+		// the collector's own stats are fetched to check the api key, they aren't part of the crawl
+		if user == "current" {
+			report.Skipped++
+			return nil
+		}
+		body := new(userclient.StatsOKBody)
+		if err := json.NewDecoder(resp.Body).Decode(body); err != nil {
+			return err
+		}
+		report.Stats++
+		return s.SaveUserStats(runID, user, body.Data, fetched)
+	}
+	report.Skipped++
+	return nil
+}
+
+// statsUser returns the user of a /users/{user}/stats/{range} path split on /, or "" for other paths
+func statsUser(parts []string) string {
+	for i := 0; i+2 < len(parts); i++ {
+		if parts[i] == "users" && parts[i+2] == "stats" {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// cacheDirs returns the dirs given, or every cache directory in the working directory
+func cacheDirs(dirs []string) ([]string, error) {
+	if len(dirs) > 0 {
+		return dirs, nil
+	}
+	return filepath.Glob(cacheDirPrefix + "[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9]")
+}
+
+// importCache is the handler of the import-cache command
+func importCache() error {
+	if *databaseFile == "" {
+		return errorx.IllegalArgument.New("import-cache writes the --database, it can't be empty")
+	}
+	s, err := OpenStore(*databaseFile)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	dirs, err := cacheDirs(*importCacheDirs)
+	if err != nil {
+		return err
+	}
+	report := &CacheImportReport{}
+	for _, dir := range dirs {
+		if err := ImportCacheDir(s, dir, report); err != nil {
+			return err
+		}
+		logger.Debug(fmt.Sprintf("Imported %s", dir))
+	}
+	logger.Info("Imported cache directories",
+		zap.Int("directories", len(dirs)),
+		zap.Int("leaderboards", report.Leaderboards),
+		zap.Int("stats", report.Stats),
+		zap.Int("skipped", report.Skipped),
+		zap.Int("unreadable", report.Unreadable))
+	return nil
+}
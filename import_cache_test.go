@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gregjones/httpcache/diskcache"
+	"github.com/peterbourgon/diskv"
+)
+
+// cacheTestResponse dumps a response the way Transport caches it
+func cacheTestResponse(source, body string) []byte {
+	return []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nDate: Tue, 01 Jan 2019 15:04:05 GMT\r\n"+
+		"X-Source-Request: %s\r\nContent-Length: %d\r\n\r\n%s", source, len(body), body))
+}
+
+func TestImportCacheDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheDir := filepath.Join(dir, ".cache-2019-01-01")
+
+	cache := NewIntegrityCache(diskcache.NewWithDiskv(diskv.New(diskv.Options{BasePath: filepath.Join(cacheDir, "last_7_days")})))
+	entries := map[string]string{
+		"https://wakatime.com/api/v1/leaders?api_key=k&page=1": `{"page":1,"total_pages":1,"data":[
+			{"rank":1,"user":{"id":"a","username":"alice"},"running_total":{"total_seconds":3600}},
+			{"rank":2,"user":{"id":"b"}}]}`,
+		"https://wakatime.com/api/v1/users/a/stats/last_7_days?api_key=k": `{"data":{"total_seconds":3600,
+			"languages":[{"name":"Go","total_seconds":3600,"percent":100}],"editors":[{"name":"Vim"}]}}`,
+		"https://wakatime.com/api/v1/users/current/stats/last_7_days?api_key=k": `{"data":{"total_seconds":60}}`,
+		"https://wakatime.com/api/v1/users/current?api_key=k":                   `{"data":{"id":"me"}}`,
+	}
+	for source, body := range entries {
+		cache.Set("GET "+source, cacheTestResponse(source, body))
+	}
+	// an entry cut short while being written
+	cache.Cache.Set("GET truncated", []byte("WKCE"))
+
+	s, err := OpenStore(filepath.Join(dir, "wakatime.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// importing again must not duplicate anything
+	report := &CacheImportReport{}
+	for i := 0; i < 2; i++ {
+		if err := ImportCacheDir(s, cacheDir, report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if report.Leaderboards != 2 || report.Stats != 2 || report.Skipped != 4 || report.Unreadable != 2 {
+		t.Errorf("report = %+v", report)
+	}
+
+	counts := map[string]int{
+		"SELECT COUNT(*) FROM runs WHERE snapshot_date = '2019-01-01' AND range_name = 'last_7_days' AND result = 'imported'": 1,
+		"SELECT COUNT(*) FROM leaderboard_snapshots":                                                       2,
+		"SELECT COUNT(*) FROM user_stats WHERE user_id = 'a' AND collected_at LIKE '2019-01-01 15:04:05%'": 1,
+		"SELECT COUNT(*) FROM stat_breakdowns":                                                             2,
+		"SELECT COUNT(*) FROM users WHERE first_seen LIKE '2019-01-01%'":                                   2,
+	}
+	for query, want := range counts {
+		var got int
+		if err := s.db.QueryRow(query).Scan(&got); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		if got != want {
+			t.Errorf("%s = %d, want %d", query, got, want)
+		}
+	}
+}
+
+func TestImportCacheDir_MergesIntoCollectedRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheDir := filepath.Join(dir, ".cache-2019-01-01")
+
+	cache := NewIntegrityCache(diskcache.NewWithDiskv(diskv.New(diskv.Options{BasePath: filepath.Join(cacheDir, "last_7_days")})))
+	source := "https://wakatime.com/api/v1/leaders?api_key=k&page=1"
+	cache.Set("GET "+source, cacheTestResponse(source, `{"page":1,"total_pages":1,"data":[{"rank":1,"user":{"id":"a"}}]}`))
+
+	s, err := OpenStore(filepath.Join(dir, "wakatime.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	runID := recordTestRun(t, s, time.Date(2019, 1, 1, 12, 0, 0, 0, time.Local))
+
+	if err := ImportCacheDir(s, cacheDir, &CacheImportReport{}); err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{
+		"SELECT COUNT(*) FROM runs": 1,
+		fmt.Sprintf("SELECT COUNT(*) FROM leaderboard_snapshots WHERE run_id = %d", runID): 2,
+	}
+	for query, want := range counts {
+		var got int
+		if err := s.db.QueryRow(query).Scan(&got); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		if got != want {
+			t.Errorf("%s = %d, want %d", query, got, want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"go.uber.org/zap"
+)
+
+var (
+	storageNamespace = errorx.NewNamespace("storage")
+
+	CorruptJournal = storageNamespace.NewType("corrupt_journal")
+)
+
+const (
+	// journalBatchSize is the number of buffered records that forces a flush
+	journalBatchSize = 64
+	journalFrameSize = 8
+	// journalFlushInterval bounds how long a buffered record waits for its batch to fill
+	journalFlushInterval = time.Second
+	// journalCompactSize is the journal size past which it is compacted into the snapshot
+	journalCompactSize = 1024 * 1024
+	// journalMaxRecord guards against allocating garbage lengths from a corrupt frame
+	journalMaxRecord = 16 * 1024 * 1024
+)
+
+type journalRecord[K comparable, V any] struct {
+	Key   K
+	Value V
+}
+
+// Journal is an append only log of key/value updates. Records are buffered and
+// written with an fsync once a batch fills up or Flush is called. Each record is
+// framed with its length and a crc32 so a torn write at the end is detected on replay.
+type Journal[K comparable, V any] struct {
+	path  string
+	batch int
+
+	lock    sync.Mutex
+	file    *os.File
+	pending bytes.Buffer
+	count   int
+}
+
+func NewJournal[K comparable, V any](path string, batch int) *Journal[K, V] {
+	return &Journal[K, V]{path: path, batch: batch}
+}
+
+// Append buffers an update of key to value, flushing when the batch is full
+func (j *Journal[K, V]) Append(key K, value V) error {
+	payload := new(bytes.Buffer)
+	if err := gob.NewEncoder(payload).Encode(journalRecord[K, V]{Key: key, Value: value}); err != nil {
+		return err
+	}
+	var frame [journalFrameSize]byte
+	binary.BigEndian.PutUint32(frame[:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(payload.Bytes()))
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.pending.Write(frame[:])
+	j.pending.Write(payload.Bytes())
+	j.count++
+	if j.count >= j.batch {
+		return j.flush()
+	}
+	return nil
+}
+
+// Flush writes and fsyncs all buffered records
+func (j *Journal[K, V]) Flush() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.flush()
+}
+
+func (j *Journal[K, V]) flush() error {
+	if j.count == 0 {
+		return nil
+	}
+	if j.file == nil {
+		f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		j.file = f
+	}
+	if _, err := j.file.Write(j.pending.Bytes()); err != nil {
+		return err
+	}
+	j.pending.Reset()
+	j.count = 0
+	return j.file.Sync()
+}
+
+// Replay calls fn for every intact record in order and returns how many were applied.
+// Anything after the first damaged record is cut off the journal.
+func (j *Journal[K, V]) Replay(fn func(key K, value V)) (int, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	applied := 0
+	for {
+		record, n, err := readJournalRecord[K, V](r)
+		if err == io.EOF {
+			return applied, nil
+		}
+		if err != nil {
+			logger.Warn("Truncating damaged journal", zap.String("file", j.path), zap.Int64("offset", offset), zap.Error(err))
+			return applied, os.Truncate(j.path, offset)
+		}
+		fn(record.Key, record.Value)
+		offset += n
+		applied++
+	}
+}
+
+func readJournalRecord[K comparable, V any](r io.Reader) (*journalRecord[K, V], int64, error) {
+	var frame [journalFrameSize]byte
+	// a clean end of the journal is io.EOF, a partial frame io.ErrUnexpectedEOF
+	if _, err := io.ReadFull(r, frame[:]); err != nil {
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(frame[:4])
+	if length > journalMaxRecord {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(frame[4:]) {
+		return nil, 0, CorruptJournal.New("checksum mismatch")
+	}
+	record := &journalRecord[K, V]{}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(record); err != nil {
+		return nil, 0, CorruptJournal.Wrap(err, "undecodable record")
+	}
+	return record, int64(journalFrameSize + len(payload)), nil
+}
+
+// Size returns the bytes written to the journal and still buffered
+func (j *Journal[K, V]) Size() (int64, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	size := int64(j.pending.Len())
+	stat, err := os.Stat(j.path)
+	if os.IsNotExist(err) {
+		return size, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return size + stat.Size(), nil
+}
+
+// Truncate discards every record, called once they are part of a snapshot
+func (j *Journal[K, V]) Truncate() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.pending.Reset()
+	j.count = 0
+	if j.file != nil {
+		if err := j.file.Close(); err != nil {
+			return err
+		}
+		j.file = nil
+	}
+	err := os.Truncate(j.path, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Close flushes buffered records and closes the journal file
+func (j *Journal[K, V]) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err := j.flush(); err != nil {
+		return err
+	}
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournal_ReplayTruncatesTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.tmp.journal")
+
+	j := NewJournal[string, bool](path, 2)
+	j.Append("a", false)
+	j.Append("b", false)
+	j.Append("a", true)
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stat, _ := os.Stat(path)
+	intact := stat.Size()
+
+	// simulate a crash part way through writing a record
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 40, 1, 2})
+	f.Close()
+
+	got := map[string]bool{}
+	applied, err := NewJournal[string, bool](path, 2).Replay(func(key string, value bool) {
+		got[key] = value
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != 3 || !got["a"] || got["b"] {
+		t.Errorf("Replay() applied %d, got %v", applied, got)
+	}
+	if stat, _ := os.Stat(path); stat.Size() != intact {
+		t.Errorf("journal size = %d, want %d after truncating the torn record", stat.Size(), intact)
+	}
+}
+
+func TestPersistentMap_RecoversFromJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "users.tmp")
+
+	m := NewPersistentMap[string, bool](file, usersStateKind, 0)
+	m.Set("a", false)
+	if err := m.Write(); err != nil {
+		t.Fatal(err)
+	}
+	m.Set("a", true)
+	m.Set("b", false)
+	// crash after the journal was flushed but before the next snapshot
+	if err := m.journal.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered := NewPersistentMap[string, bool](file, usersStateKind, 0)
+	if err := recovered.Read(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := recovered.Get("a"); !v || recovered.Len() != 2 {
+		t.Errorf("recovered a = %v, Len() = %d", v, recovered.Len())
+	}
+
+	if err := recovered.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := os.Stat(file + ".journal"); err != nil || stat.Size() != 0 {
+		t.Errorf("journal was not compacted into the snapshot: %v", err)
+	}
+}
@@ -3,12 +3,14 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"strconv"
 	"time"
 
 	"github.com/pquerna/cachecontrol"
+	"go.uber.org/zap"
 )
 
 const (
@@ -45,6 +47,8 @@ type Transport struct {
 	Transport  http.RoundTripper
 	Cache      Cache
 	THeuristic Heuristic
+	// If set, cache lookups, upstream latency and responses are recorded
+	Metrics *TransportMetrics
 	// If true, responses returned from the cache will be given an extra header, X-From-Cache
 	MarkCachedResponses bool
 }
@@ -82,9 +86,16 @@ func DefaultHeuristic() Heuristic {
 func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
 	cacheKey := t.THeuristic.CacheKey(req)
 	cacheable := t.THeuristic.Cacheable(req)
+	endpoint := endpointLabel(req.URL)
 	var cachedResp *http.Response
 	if cacheable {
 		cachedResp, err = CachedResponse(t.Cache, req, cacheKey)
+		if err != nil {
+			// A partially written entry can't be served, drop it and fetch it again
+			logger.Warn("Evicting unreadable cache entry", zap.String("key", cacheKey), zap.Error(err))
+			t.Cache.Delete(cacheKey)
+			cachedResp, err = nil, nil
+		}
 	} else {
 		// Need to invalidate an existing value
 		t.Cache.Delete(cacheKey)
@@ -102,13 +113,26 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 			return nil, err
 		}
 		if len(reasons) == 0 && time.Now().Before(expires) {
+			t.Metrics.cacheLookup(endpoint, cacheHit)
+			t.Metrics.countResponse(endpoint, cachedResp)
 			return cachedResp, nil
 		}
 	}
+	switch {
+	case !cacheable:
+		t.Metrics.cacheLookup(endpoint, cacheBypass)
+	case cachedResp != nil:
+		t.Metrics.cacheLookup(endpoint, cacheRevalidate)
+	default:
+		t.Metrics.cacheLookup(endpoint, cacheMiss)
+	}
+	start := time.Now()
 	resp, err = transport.RoundTrip(req)
 	if err != nil {
 		return nil, err
 	}
+	t.Metrics.observeLatency(endpoint, time.Since(start).Seconds())
+	t.Metrics.countResponse(endpoint, resp)
 	if resp.StatusCode >= 300 && resp.StatusCode != 429 && resp.StatusCode != 404 {
 		b, _ := httputil.DumpResponse(resp, true)
 		logger.Warn("Status Code above 300\nUrl:" + req.URL.String() + "\n" + string(b))
@@ -141,7 +165,18 @@ func CachedResponse(c Cache, req *http.Request, cacheKey string) (resp *http.Res
 	}
 
 	b := bytes.NewBuffer(cachedVal)
-	return http.ReadResponse(bufio.NewReader(b), req)
+	resp, err = http.ReadResponse(bufio.NewReader(b), req)
+	if err != nil {
+		return nil, err
+	}
+	// read the body up front so a truncated entry is detected here rather than by the caller
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
 }
 
 // NewHeuristicTransport return a new Transport that uses the default Time based Heuristic for 10 years
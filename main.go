@@ -2,7 +2,8 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -10,12 +11,14 @@ import (
 	"os/signal"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/alecthomas/kingpin"
 	"github.com/cenkalti/backoff"
 	httptransport "github.com/go-openapi/runtime/client"
 	"github.com/go-openapi/strfmt"
+	"github.com/gregjones/httpcache"
 	"github.com/gregjones/httpcache/diskcache"
 	"github.com/jinzhu/copier"
 	"github.com/joomcode/errorx"
@@ -31,11 +34,83 @@ import (
 )
 
 var (
-	leaderRange    = kingpin.Arg("range", "range pick from 7, 30, 180, 365").Default("7").Int()
+	collectCmd  = kingpin.Command("collect", "collect leader board stats").Default()
+	leaderRange = collectCmd.Arg("range", "range pick from 7, 30, 180, 365").Default("7").Int()
+
+	cacheCmd         = kingpin.Command("cache", "manage the http response cache")
+	cacheVerifyCmd   = cacheCmd.Command("verify", "scan a cache directory for corrupt entries")
+	cacheVerifyDir   = cacheVerifyCmd.Arg("dir", "cache directory to scan").Required().ExistingDir()
+	cacheVerifyClean = cacheVerifyCmd.Flag("clean", "remove corrupt entries").Bool()
+
+	convertCmd = kingpin.Command("convert", "re-encode a state file such as allusers.array or users.tmp")
+	convertSrc = convertCmd.Arg("src", "file to convert").Required().ExistingFile()
+	convertDst = convertCmd.Arg("dst", "file to write, defaults to converting src in place").String()
+	convertTo  = convertCmd.Flag("to", "codec to write, defaults to the one picked by the extension of dst").Enum("gob", "json", "msgpack", "cbor")
+
+	exportCmd    = kingpin.Command("export", "write collected stats from the --database as csv, jsonl or parquet")
+	exportTable  = exportCmd.Arg("table", "users for a summary per user, languages for time per user and language, leaderboard for ranks").Default("users").Enum(exportTableNames()...)
+	exportFormat = exportCmd.Flag("format", "output format").Short('f').Default("csv").Enum("csv", "jsonl", "parquet")
+	exportDate   = exportCmd.Flag("date", "only runs of this snapshot date, eg 2019-01-01").String()
+	exportRange  = exportCmd.Flag("range", "only runs of this range, pick from 7, 30, 180, 365").Enum(leaderRanges...)
+	exportOutput = exportCmd.Flag("output", "file to write, defaults to stdout").Short('o').String()
+
+	importCacheCmd  = kingpin.Command("import-cache", "backfill the --database from the responses kept in .cache-YYYY-MM-DD directories")
+	importCacheDirs = importCacheCmd.Arg("dirs", "cache directories to import, defaults to every one in the working directory").ExistingDirs()
+
+	reportCmd    = kingpin.Command("report", "aggregate the stats of a snapshot in the --database")
+	reportRange  = reportCmd.Arg("range", "range pick from 7, 30, 180, 365").Default("7").Enum(leaderRanges...)
+	reportDate   = reportCmd.Flag("date", "snapshot date to report on, defaults to the latest").String()
+	reportFormat = reportCmd.Flag("format", "output format").Short('f').Default("table").Enum("table", "markdown", "html")
+	reportTop    = reportCmd.Flag("top", "number of languages, editors and operating systems to list").Default("10").Int()
+	reportOutput = reportCmd.Flag("output", "file to write, defaults to stdout").Short('o').String()
+
+	serveCmd      = kingpin.Command("serve", "collect on a schedule and expose prometheus metrics")
+	serveRange    = serveCmd.Arg("range", "range pick from 7, 30, 180, 365").Default("7").Int()
+	serveListen   = serveCmd.Flag("listen", "address to serve /metrics on").Default(":9090").String()
+	serveInterval = serveCmd.Flag("interval", "time between collections when no schedule is given").Default("6h").Duration()
+	serveSchedule = serveCmd.Flag("schedule", "cron schedule per range, eg 7=\"0 */6 * * *\" 365=@weekly").PlaceHolder("RANGE=SPEC").StringMap()
+	serveJitter   = serveCmd.Flag("jitter", "maximum random delay added to each scheduled run").Default("5m").Duration()
+	serveState    = serveCmd.Flag("schedule-state", "file recording the last and next run of each range").Default("schedule.state").String()
+)
+
+var (
 	slackWebhook   = kingpin.Flag("slack-webhook", "webhook for slack errors").Envar("SLACK_HOOK").Short('w').String()
 	wakatimeAPIKey = kingpin.Flag("wakatime-api-key", "wakatime api client key").Envar("WAKATIME_API_KEY").Short('k').String()
 	verbose        = kingpin.Flag("verbose", "verbose level").Envar("COLLECTOR_VERBOSE").Short('v').Bool()
-	clientTimeout  = kingpin.Flag("http-timeout", "http client timeout").Default("10").Int()
+	clientTimeout  = kingpin.Flag("http-timeout", "http client and smtp timeout in seconds").Default("10").Int()
+	recordFile     = kingpin.Flag("record", "record all http interactions to a cassette file").PlaceHolder("CASSETTE").String()
+	replayFile     = kingpin.Flag("replay", "serve all http interactions from a cassette file").PlaceHolder("CASSETTE").String()
+	harFile        = kingpin.Flag("har", "write all http traffic including cache hits to a HAR file").PlaceHolder("FILE").String()
+	waitForLock    = kingpin.Flag("wait", "wait for another instance to release the working directory instead of exiting").Bool()
+	storageCodec   = kingpin.Flag("codec", "codec for state files whose extension doesn't pick one").Default("gob").Enum("gob", "json", "msgpack", "cbor")
+	lockStale      = kingpin.Flag("lock-stale", "time without a heartbeat after which a lock is considered abandoned").Default("2m").Duration()
+	slackToken     = kingpin.Flag("slack-token", "slack bot token, posts a run's alerts as replies to a message showing its progress").Envar("SLACK_TOKEN").String()
+	slackChannel   = kingpin.Flag("slack-channel", "channel the slack bot posts to").String()
+	slackBatch     = kingpin.Flag("slack-batch-window", "post slack alerts arriving within this window as one message").Default("2s").Duration()
+	slackRate      = kingpin.Flag("slack-rate", "most slack messages to post per second").Default("1").Float64()
+	slackDedup     = kingpin.Flag("slack-dedup-window", "post repeats of a slack alert within this window as one summary, 0 to disable").Default("10m").Duration()
+	slackDedupKeys = kingpin.Flag("slack-dedup-field", "field whose value tells repeated slack alerts apart besides their level, message and logger fields").Strings()
+	slackFormats   = kingpin.Flag("slack-format", "render slack alerts from LEVEL up as text or blocks").Default("error=blocks").PlaceHolder("LEVEL=FORMAT").StringMap()
+	slackRetry     = kingpin.Flag("slack-retry", "how long to retry a failing slack post with backoff").Default("1m").Duration()
+	slackCooldown  = kingpin.Flag("slack-cooldown", "pause slack posts for this long after 5 consecutive failures").Default("1m").Duration()
+	slackDrain     = kingpin.Flag("slack-drain-timeout", "how long to wait for queued alerts to be delivered on exit").Default("10s").Duration()
+	slackLevel     = kingpin.Flag("slack-level", "lowest level posted to slack").Default("info").String()
+	slackSpool     = kingpin.Flag("slack-dead-letter", "file spooling slack alerts that couldn't be posted until the next start, empty to drop them").Default("slack.deadletter").String()
+	discordWebhook = kingpin.Flag("discord-webhook", "discord webhook for alerts").Envar("DISCORD_HOOK").String()
+	discordLevel   = kingpin.Flag("discord-level", "lowest level posted to discord").Default("error").String()
+	teamsWebhook   = kingpin.Flag("teams-webhook", "microsoft teams incoming webhook for alerts").Envar("TEAMS_HOOK").String()
+	teamsLevel     = kingpin.Flag("teams-level", "lowest level posted to teams").Default("error").String()
+	smtpAddr       = kingpin.Flag("smtp-addr", "smtp server mailing alerts").PlaceHolder("HOST:PORT").String()
+	smtpUser       = kingpin.Flag("smtp-user", "smtp username, no authentication when empty").String()
+	smtpPassword   = kingpin.Flag("smtp-password", "smtp password").Envar("SMTP_PASSWORD").String()
+	emailFrom      = kingpin.Flag("email-from", "sender of alert mails").String()
+	emailTo        = kingpin.Flag("email-to", "recipient of alert mails").Strings()
+	emailLevel     = kingpin.Flag("email-level", "lowest level mailed").Default("error").String()
+	webhookURL     = kingpin.Flag("webhook-url", "url alerts are posted to as JSON").Envar("ALERT_WEBHOOK").String()
+	webhookBody    = kingpin.Flag("webhook-template", "text/template file rendering the JSON body of webhook alerts").PlaceHolder("FILE").String()
+	webhookLevel   = kingpin.Flag("webhook-level", "lowest level posted to the webhook").Default("error").String()
+	alertRoutes    = kingpin.Flag("alert-routes", "JSON file routing alerts by level, logger, message and fields to their own destinations").PlaceHolder("FILE").String()
+	databaseFile   = kingpin.Flag("database", "sqlite database recording every run, empty to disable").Default("wakatime.db").String()
 
 	BuildDate  string
 	GitCommit  string
@@ -45,9 +120,20 @@ var (
 )
 
 var (
+	command      string
 	logger       *zap.Logger
 	slackHooker  *SlackCore
-	mappedObject DiskMappedObject
+	notifiers    []Notifier
+	mappedObject *PersistentMap[string, bool]
+	harRecorder  *HARTransport
+	dirLock      *DirLock
+	store        *Store
+
+	// quietProgress disables progress bars, used when running as a daemon
+	quietProgress bool
+
+	transportMetrics = NewTransportMetrics(metricsRegistry)
+	collectorMetrics = NewCollectorMetrics(metricsRegistry)
 )
 
 var (
@@ -56,8 +142,31 @@ var (
 
 func init() {
 	kingpin.Version(GitSummary + "; built on " + BuildDate)
-	kingpin.CommandLine.Parse(os.Args[1:])
+	// main replaces it once the flags are parsed
+	logger = zap.NewNop()
+}
 
+// validateFlags checks the flags kingpin can't check on its own
+func validateFlags() error {
+	if *lockStale <= 0 {
+		return errorx.IllegalArgument.New("--lock-stale must be positive")
+	}
+	// a NaN rate fails this too
+	if !(*slackRate > 0) {
+		return errorx.IllegalArgument.New("--slack-rate must be positive")
+	}
+	if *slackToken != "" && *slackChannel == "" {
+		return errorx.IllegalArgument.New("--slack-channel is required with --slack-token")
+	}
+	if *smtpAddr != "" && len(*emailTo) > 0 && *emailFrom == "" {
+		return errorx.IllegalArgument.New("--email-from is required with --email-to")
+	}
+	return nil
+}
+
+// setupLogger builds the logger writing to the console and every notifier configured by the flags
+func setupLogger() {
+	var err error
 	config := zap.Config{
 		Level:       zap.NewAtomicLevelAt(zap.DebugLevel),
 		Development: false,
@@ -66,7 +175,6 @@ func init() {
 		OutputPaths:      []string{"stderr"},
 		ErrorOutputPaths: []string{"stderr"},
 	}
-	var err error
 	var options []zap.Option
 	var cores []zapcore.Core
 	if *verbose {
@@ -88,17 +196,29 @@ func init() {
 
 	cores = append(cores, zapcore.NewCore(encoder, consoleErrors, highPriority))
 	cores = append(cores, zapcore.NewCore(encoder, consoleDebugging, lowPriority))
-	if *slackWebhook != "" {
-		var config1 zapcore.EncoderConfig
-		if err := copier.Copy(&config1, &config.EncoderConfig); err != nil {
-			panic(err)
-		}
-		config1.TimeKey = ""
-		config1.LevelKey = ""
-		config1.CallerKey = ""
-		encoder := NewKVEncoder(config1)
-		slackHooker = NewSlackCore(*slackWebhook, encoder, zap.InfoLevel)
-		cores = append(cores, slackHooker)
+	var config1 zapcore.EncoderConfig
+	if err := copier.Copy(&config1, &config.EncoderConfig); err != nil {
+		panic(err)
+	}
+	config1.TimeKey = ""
+	config1.LevelKey = ""
+	config1.CallerKey = ""
+	alertEncoder := NewKVEncoder(config1)
+	if *slackWebhook != "" || *slackToken != "" {
+		slackHooker = newSlackNotifier(*slackWebhook, alertEncoder, notifyLevel("--slack-level", *slackLevel), *slackSpool)
+		slackHooker.Token = *slackToken
+		slackHooker.Channel = *slackChannel
+		slackHooker.limiter = newTokenBucket(*slackRate, 1)
+		slackHooker.Formats, err = parseSlackFormats(*slackFormats)
+		kingpin.FatalIfError(err, "--slack-format")
+		notifiers = append(notifiers, slackHooker)
+	}
+	notifiers = append(notifiers, newNotifiers()...)
+	if *alertRoutes != "" {
+		notifiers = append(notifiers, newRouteNotifiers(*alertRoutes, alertEncoder)...)
+	}
+	for _, notifier := range notifiers {
+		cores = append(cores, notifier)
 	}
 	options = append(options, zap.WrapCore(func(core zapcore.Core) zapcore.Core {
 		return zapcore.NewTee(cores...)
@@ -109,8 +229,11 @@ func init() {
 	}
 }
 
-func rangeLeaderBoardString() string {
-	switch *leaderRange {
+// leaderRanges are the leader board ranges in days
+var leaderRanges = []string{"7", "30", "180", "365"}
+
+func rangeLeaderBoardString(leaderRange int) string {
+	switch leaderRange {
 	case 7:
 		return string(models.RangeLast7Days)
 	case 30:
@@ -125,24 +248,281 @@ func rangeLeaderBoardString() string {
 }
 
 func main() {
+	var err error
+	command, err = kingpin.CommandLine.Parse(os.Args[1:])
+	kingpin.FatalIfError(err, "")
+	if err := validateFlags(); err != nil {
+		kingpin.Fatalf("%s", errorx.Cast(err).Message())
+	}
+	setupLogger()
+	// alerts still queued on exit are spooled to the dead letter files, which the lock
+	// guards too, so the notifiers are closed before it is released
+	defer func() {
+		closeNotifiers()
+		dirLock.Release()
+	}()
+
+	switch command {
+	case cacheVerifyCmd.FullCommand():
+		if code := verifyCache(); code != 0 {
+			closeNotifiers()
+			os.Exit(code)
+		}
+		return
+	case convertCmd.FullCommand():
+		if err := convertFile(*convertSrc, *convertDst, *convertTo); err != nil {
+			logger.Fatal(err.Error())
+		}
+		return
+	case importCacheCmd.FullCommand():
+		if err := importCache(); err != nil {
+			logger.Fatal(err.Error())
+		}
+		return
+	case reportCmd.FullCommand():
+		if err := report(); err != nil {
+			logger.Fatal(err.Error())
+		}
+		return
+	case exportCmd.FullCommand():
+		if err := export(); err != nil {
+			logger.Fatal(err.Error())
+		}
+		return
+	}
+
+	dirLock, err = lockWorkingDir()
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	if *databaseFile != "" {
+		store, err = openStore()
+		if err != nil {
+			closeNotifiers()
+			dirLock.Release()
+			logger.Fatal(err.Error())
+		}
+		defer store.Close()
+	}
+
+	// holding the lock means no other instance is spooling to the dead letter files
+	for _, notifier := range notifiers {
+		if replayer, ok := notifier.(interface{ Replay() error }); ok {
+			if err := replayer.Replay(); err != nil {
+				logger.Warn(err.Error())
+			}
+		}
+	}
+
 	c := make(chan os.Signal, 1)
 
 	go func() {
 		signal.Notify(c, os.Interrupt)
 		<-c
-		mappedObject.ForceSync()
+		closeUsers()
+		closeHAR()
+		store.Close()
+		closeNotifiers()
+		dirLock.Release()
 		os.Exit(1)
 	}()
 
-	run()
-	mappedObject.ForceSync()
+	go func() {
+		<-dirLock.Lost()
+		// the directory belongs to another process now, leave the users and dead letter files to it
+		for _, notifier := range notifiers {
+			if discarder, ok := notifier.(interface{ Discard() }); ok {
+				discarder.Discard()
+			}
+		}
+		closeHAR()
+		store.Close()
+		closeNotifiers()
+		logger.Fatal("Lost the lock on the working directory, stopping")
+	}()
+
+	if command == serveCmd.FullCommand() {
+		serve()
+		return
+	}
+	if err := run(*leaderRange, time.Now()); err != nil {
+		store.Close()
+		closeNotifiers()
+		dirLock.Release()
+		logger.Fatal(err.Error())
+	}
+	closeHAR()
+}
+
+// slackFooter names where and what is running below slack alerts rendered with blocks
+func slackFooter() blockFooter {
+	footer := blockFooter{Version: GitSummary}
+	footer.Hostname, _ = os.Hostname()
+	switch command {
+	case collectCmd.FullCommand():
+		footer.Range = rangeLeaderBoardString(*leaderRange)
+	case serveCmd.FullCommand():
+		footer.Range = rangeLeaderBoardString(*serveRange)
+	}
+	return footer
+}
+
+// newNotifiers creates a notifier for every service whose flags are set, besides slack
+func newNotifiers() []Notifier {
+	timeout := time.Duration(*clientTimeout) * time.Second
+	var created []Notifier
+	if *discordWebhook != "" {
+		created = append(created, NewNotifierCore("discord", NewDiscordSink(*discordWebhook, timeout), notifyLevel("--discord-level", *discordLevel)))
+	}
+	if *teamsWebhook != "" {
+		created = append(created, NewNotifierCore("teams", NewTeamsSink(*teamsWebhook, timeout), notifyLevel("--teams-level", *teamsLevel)))
+	}
+	// without --email-to the smtp flags only serve email routes
+	if *smtpAddr != "" && len(*emailTo) > 0 {
+		sink := NewEmailSink(*smtpAddr, *smtpUser, *smtpPassword, *emailFrom, *emailTo, timeout)
+		created = append(created, NewNotifierCore("email", sink, notifyLevel("--email-level", *emailLevel)))
+	}
+	if *webhookURL != "" {
+		var body []byte
+		if *webhookBody != "" {
+			var err error
+			body, err = ioutil.ReadFile(*webhookBody)
+			kingpin.FatalIfError(err, "--webhook-template")
+		}
+		sink, err := NewWebhookSink(*webhookURL, string(body), timeout)
+		kingpin.FatalIfError(err, "--webhook-template")
+		created = append(created, NewNotifierCore("webhook", sink, notifyLevel("--webhook-level", *webhookLevel)))
+	}
+	return created
+}
+
+// newSlackNotifier creates a slack core posting to hookURL set up from the slack flags
+func newSlackNotifier(hookURL string, encoder zapcore.Encoder, level zapcore.Level, spool string) *SlackCore {
+	core := NewSlackCore(hookURL, encoder, level)
+	core.BatchWindow = *slackBatch
+	core.dedup = newDeduper(*slackDedup, *slackDedupKeys)
+	core.Footer = slackFooter()
+	core.RetryFor = *slackRetry
+	core.breaker = newCircuitBreaker(5, *slackCooldown)
+	core.deadLetter = &deadLetter{path: spool}
+	return core
+}
+
+// newRouteNotifiers creates a notifier for every route in path
+func newRouteNotifiers(path string, encoder zapcore.Encoder) []Notifier {
+	routes, err := loadAlertRoutes(path)
+	kingpin.FatalIfError(err, "--alert-routes")
+	timeout := time.Duration(*clientTimeout) * time.Second
+	created := make([]Notifier, 0, len(routes))
+	for _, route := range routes {
+		var notifier Notifier
+		switch route.Type {
+		case routeSlack:
+			// every route spools to a dead letter file of its own
+			spool := *slackSpool
+			if spool != "" {
+				spool += "." + route.Name
+			}
+			core := newSlackNotifier(route.URL, encoder.Clone(), route.level, spool)
+			core.Formats = route.formats
+			if limiter := route.limiter(); limiter != nil {
+				core.limiter = limiter
+			}
+			notifier = core
+		default:
+			var sink NotifierSink
+			switch route.Type {
+			case routeDiscord:
+				sink = NewDiscordSink(route.URL, timeout)
+			case routeTeams:
+				sink = NewTeamsSink(route.URL, timeout)
+			case routeEmail:
+				if *smtpAddr == "" || *emailFrom == "" {
+					kingpin.Fatalf("--smtp-addr and --email-from are required by the email route %s", route.Name)
+				}
+				sink = NewEmailSink(*smtpAddr, *smtpUser, *smtpPassword, *emailFrom, route.To, timeout)
+			case routeWebhook:
+				sink, err = NewWebhookSink(route.URL, route.Template, timeout)
+				kingpin.FatalIfError(err, "--alert-routes %s", route.Name)
+			}
+			core := NewNotifierCore(route.Name, sink, route.level)
+			if limiter := route.limiter(); limiter != nil {
+				core.limiter = limiter
+			}
+			notifier = core
+		}
+		created = append(created, newRouteCore(route, notifier))
+	}
+	return created
+}
+
+// notifyLevel parses the level given to flag
+func notifyLevel(flag, text string) zapcore.Level {
+	var level zapcore.Level
+	kingpin.FatalIfError(level.UnmarshalText([]byte(text)), flag)
+	return level
+}
+
+// closeNotifiers delivers the queued alerts of every notifier, slack spools whatever is left after the drain timeout
+func closeNotifiers() {
+	ctx, cancel := context.WithTimeout(context.Background(), *slackDrain)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, notifier := range notifiers {
+		wg.Add(1)
+		go func(notifier Notifier) {
+			defer wg.Done()
+			if err := notifier.Close(ctx); err != nil {
+				logger.Warn("Failed to deliver alerts", zap.Error(err))
+			}
+		}(notifier)
+	}
+	wg.Wait()
+}
+
+// closeUsers flushes the users state of the current run
+func closeUsers() {
+	if mappedObject == nil {
+		return
+	}
+	if err := mappedObject.Close(); err != nil {
+		logger.Error("Failed to save users", zap.Error(err))
+	}
+}
+
+// openStore opens the --database, a replay records its runs in memory so they don't mix with collected ones
+func openStore() (*Store, error) {
+	if *replayFile != "" {
+		return OpenStore(":memory:")
+	}
+	return OpenStore(*databaseFile)
+}
+
+// lockWorkingDir keeps other instances from writing the users files and caches alongside us
+func lockWorkingDir() (*DirLock, error) {
+	if *waitForLock {
+		return WaitDirLock(context.Background(), ".", *lockStale, 5*time.Second)
+	}
+	return AcquireDirLock(".", *lockStale)
+}
+
+// closeHAR closes the HAR file of the current run, its entries were written as they were recorded
+func closeHAR() {
+	if harRecorder == nil {
+		return
+	}
+	if err := harRecorder.Close(); err != nil {
+		logger.Error("Failed to close HAR file", zap.String("file", *harFile), zap.Error(err))
+	}
 }
 
-func run() {
+// run collects leaderRange, started is the day the run belongs to and names the cache directory
+func run(leaderRange int, started time.Time) (rerr error) {
 	{
 		name, err := os.Hostname()
 		if err != nil {
-			panic(err)
+			return err
 		}
 		logger.Info("Starting Collector", zap.String("node", name), zap.String("version", GitSummary))
 	}
@@ -153,13 +533,53 @@ func run() {
 	defaultT := apiclient.DefaultTransportConfig()
 
 	// cache the requests since i want to retrieve them later
-	rangeLeaderBoard := rangeLeaderBoardString()
+	rangeLeaderBoard := rangeLeaderBoardString(leaderRange)
+	defer collectorMetrics.finishRun(rangeLeaderBoard, &rerr)
+
+	runID, err := store.StartRun(rangeLeaderBoard, started)
+	if err != nil {
+		return err
+	}
+	summary := newRunSummary(runID, rangeLeaderBoard, time.Now())
+	if err := slackHooker.StartThread(fmt.Sprintf("Run started: %s", rangeLeaderBoard)); err != nil {
+		logger.Warn("Posting alerts outside of a thread", zap.Error(err))
+	}
+	var users *PersistentMap[string, bool]
+	defer func() {
+		discovered, collected := 0, 0
+		if users != nil {
+			discovered, collected = users.Len(), countCollected(users)
+		}
+		if err := store.FinishRun(runID, discovered, collected, rerr); err != nil {
+			logger.Error("Failed to record the end of the run", zap.Error(err))
+		}
+		state := "Run finished"
+		if rerr != nil {
+			state = "Run failed"
+		}
+		slackHooker.UpdateThread(runProgress(state, rangeLeaderBoard, collected, discovered, 0), true)
 
-	dir := path.Join(".cache-" + time.Now().Format("2006-01-02"))
+		summary.finish(rerr, discovered, collected, time.Now())
+		previous, err := store.PreviousRun(rangeLeaderBoard, runID)
+		if err != nil {
+			logger.Warn("Failed to look up the previous run", zap.Error(err))
+		}
+		summary.Previous = previous
+		notifyRun(summary)
+	}()
+	// a panic still ends the run in the store and reaches the notifiers, it is returned as the run's error
+	defer func() {
+		if r := recover(); r != nil {
+			summary.Result = runPanicked
+			rerr = panicError(r)
+		}
+	}()
+
+	dir := path.Join(".cache-" + started.Format(snapshotDateFormat))
 	leaderBoardDir := path.Join(dir, rangeLeaderBoard)
 
 	// Setup a disk back request cache note that this is a very aggressive caching method and it doesn't follow normal standards
-	tp := NewHeuristicTransport(
+	var cache Cache = NewIntegrityCache(
 		diskcache.NewWithDiskv(
 			diskv.New(
 				diskv.Options{
@@ -167,25 +587,68 @@ func run() {
 					CacheSizeMax: 100 * 1024 * 1024,
 				})))
 
+	var upstream http.RoundTripper
+	switch {
+	case *recordFile != "" && *replayFile != "":
+		return errorx.IllegalArgument.New("--record and --replay are mutually exclusive")
+	case *replayFile != "":
+		replay, err := NewReplayTransport(*replayFile)
+		if err != nil {
+			return err
+		}
+		upstream = replay
+		// replaying must not depend on, or leave behind, anything in the disk cache
+		cache = httpcache.NewMemoryCache()
+		logger.Info("Replaying http interactions", zap.String("cassette", *replayFile))
+	case *recordFile != "":
+		record, err := NewRecordTransport(*recordFile, http.DefaultTransport)
+		if err != nil {
+			return err
+		}
+		defer record.Close()
+		upstream = record
+		// responses served from a warm disk cache would never reach the cassette
+		cache = httpcache.NewMemoryCache()
+		logger.Info("Recording http interactions", zap.String("cassette", *recordFile))
+	}
+
+	tp := NewHeuristicTransport(cache)
+	tp.Transport = upstream
+	tp.Metrics = transportMetrics
+	defer logMetrics()
+
 	logger.Debug("Setting cached directory", zap.String("Cache-Directory",
 		leaderBoardDir))
 
+	var rt http.RoundTripper = tp
+	if *harFile != "" {
+		// serve appends the traffic of every run to the file created by its first one
+		if harRecorder == nil {
+			harRecorder, err = NewHARTransport(*harFile, tp)
+			if err != nil {
+				return err
+			}
+		}
+		harRecorder.Transport = tp
+		rt = harRecorder
+	}
+
 	runtime := httptransport.NewWithClient(defaultT.Host, defaultT.BasePath, defaultT.Schemes,
-		&http.Client{Timeout: time.Duration(*clientTimeout) * time.Second, Transport: tp})
+		&http.Client{Timeout: time.Duration(*clientTimeout) * time.Second, Transport: rt})
 
 	client := apiclient.New(runtime, strfmt.Default)
 	apiKeyAuth := httptransport.APIKeyAuth("api_key", "query", *wakatimeAPIKey)
 
-	_, err := client.User.User(nil, apiKeyAuth)
+	_, err = client.User.User(nil, apiKeyAuth)
 	if err != nil {
-		logger.Fatal(err.Error())
+		return err
 	}
 	// fmt.Printf("%# v\n", pretty.Formatter(user))
 	params := userclient.NewStatsParams()
 	params.Range = string(models.RangeLast7Days)
 	_, _, err = client.User.Stats(params, apiKeyAuth)
 	if err != nil {
-		logger.Fatal(err.Error())
+		return err
 	}
 	// fmt.Printf("%# v\n", pretty.Formatter(use))
 
@@ -195,36 +658,59 @@ func run() {
 	params2.Page = &start
 	leader, err := client.Leaders.Leader(params2, apiKeyAuth)
 	if err != nil {
-		logger.Fatal(err.Error())
+		return err
 	}
 
-	bar := pb.New(int(leader.Payload.TotalPages))
-	users := make(map[string]bool, bar.Total*100)
-	addUsersFromArray(users)
+	bar := newProgressBar(int(leader.Payload.TotalPages))
+	// a replay keeps its users in memory so it neither depends on nor changes the state files
+	replaying := *replayFile != ""
 	filename := path.Join(dir, "users.tmp")
-	mappedObject = DiskMappedObject{
-		file:   filename,
-		mapped: &users,
-	}
-	mappedObject.Read()
-	defer mappedObject.Sync()
-	if err := mappedObject.PeriodicWrite(time.Second * 60); err != nil {
-		err = errorx.InitializationFailed.New("Failed to start synced users object")
-		logger.Fatal(err.Error())
+	if replaying {
+		filename = ""
+	}
+	users = NewPersistentMap[string, bool](filename, usersStateKind, int(bar.Total*100))
+	mappedObject = users
+	if !replaying {
+		// the disk cache only creates it with its first entry, and a recording bypasses the disk cache
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := users.Read(); err != nil {
+			return err
+		}
+		if err := addUsersFromArray(users); err != nil {
+			return err
+		}
+	}
+	defer closeUsers()
+	if !replaying {
+		if err := users.PeriodicWrite(time.Second * 60); err != nil {
+			return errorx.InitializationFailed.Wrap(err, "Failed to start synced users object")
+		}
 	}
 	logger.Debug("Estimating total users", zap.Int64("users", bar.Total*100))
 
-	addUsers(leader, users, mappedObject)
-	writeAllUsers(users)
+	addUsers(leader, users)
+	if err := store.SaveLeaderboardPage(runID, rangeLeaderBoard, leader.Payload, time.Now()); err != nil {
+		return err
+	}
+	if !replaying {
+		if err := writeAllUsers(users); err != nil {
+			return err
+		}
+	}
 
 	bar.Start()
 	bar.Increment()
 	for {
 		leader, err := client.Leaders.Leader(params2, apiKeyAuth)
 		if err != nil {
-			panic(err)
+			return err
+		}
+		addUsers(leader, users)
+		if err := store.SaveLeaderboardPage(runID, rangeLeaderBoard, leader.Payload, time.Now()); err != nil {
+			return err
 		}
-		addUsers(leader, users, mappedObject)
 		if *params2.Page == leader.Payload.TotalPages {
 			break
 		}
@@ -233,17 +719,15 @@ func run() {
 	}
 	bar.Finish()
 
-	logger.Debug("Actual total users", zap.Int64("users", int64(len(users))))
+	logger.Debug("Actual total users", zap.Int64("users", int64(users.Len())))
 
-	total := 0
-	for _, val := range users {
-		if val {
-			total += 1
-		}
-	}
+	total := countCollected(users)
+	collectorMetrics.UsersDiscovered.WithLabelValues(rangeLeaderBoard).Set(float64(users.Len()))
+	collectorMetrics.UsersCollected.WithLabelValues(rangeLeaderBoard).Set(float64(total))
+	collectorMetrics.UsersRemaining.WithLabelValues(rangeLeaderBoard).Set(float64(users.Len() - total))
 
 	logger.Info("Total Users Collected", zap.Int("acquired", total))
-	logger.Info("Remaining Users to be collected", zap.Int("remaining", int(len(users)-total)))
+	logger.Info("Remaining Users to be collected", zap.Int("remaining", users.Len()-total))
 
 	skippedTimeout := 0
 	skippedAccepted := 0
@@ -254,9 +738,10 @@ func run() {
 	expBackOff.MaxElapsedTime = 1 * time.Hour
 	expBackOff.Reset()
 
-	bar = pb.StartNew(len(users))
-	for key := range users {
-		if users[key] {
+	bar = newProgressBar(users.Len())
+	bar.Start()
+	for _, key := range users.Keys() {
+		if collected, _ := users.Get(key); collected {
 			bar.Increment()
 			continue
 		}
@@ -264,9 +749,11 @@ func run() {
 	retry:
 		params := userclient.NewStatsParams()
 		params.User = key
-		_, accepted, err := client.User.Stats(params, apiKeyAuth)
+		stats, accepted, err := client.User.Stats(params, apiKeyAuth)
 		if accepted != nil {
 			skippedAccepted += 1
+			summary.Accepted++
+			collectorMetrics.UsersSkipped.WithLabelValues(rangeLeaderBoard, "accepted").Inc()
 			expBackOff.Reset()
 			continue
 		}
@@ -274,24 +761,39 @@ func run() {
 			err = parseError(err)
 			switch {
 			case errorx.IsOfType(err, RateLimited):
+				collectorMetrics.RateLimited.WithLabelValues(rangeLeaderBoard).Inc()
 				duration := expBackOff.NextBackOff()
 				if duration == backoff.Stop {
 					expBackOff.Reset()
 				} else {
+					collectorMetrics.BackoffSeconds.WithLabelValues(rangeLeaderBoard).Add(duration.Seconds())
 					time.Sleep(duration)
 				}
 				goto retry
 			case errorx.IsOfType(err, Timeout):
 				skippedTimeout += 1
+				collectorMetrics.UsersSkipped.WithLabelValues(rangeLeaderBoard, "timeout").Inc()
+				recordError(summary, key, "timeout", err)
 				continue
 			case errorx.IsOfType(err, NotFound):
+				collectorMetrics.UsersSkipped.WithLabelValues(rangeLeaderBoard, "not_found").Inc()
+				recordError(summary, key, "not_found", err)
 				continue
 			}
+			collectorMetrics.Errors.WithLabelValues(rangeLeaderBoard).Inc()
 			logger.Error(err.Error())
+			recordError(summary, key, "error", err)
+		} else if stats != nil && stats.Payload != nil {
+			if err := store.SaveUserStats(runID, key, stats.Payload.Data, time.Now()); err != nil {
+				return err
+			}
 		}
-		mappedObject.lock.Lock()
-		users[key] = true
-		mappedObject.lock.Unlock()
+		users.Set(key, true)
+		total++
+		summary.CollectedThisRun++
+		slackHooker.UpdateThread(runProgress("Run in progress", rangeLeaderBoard, total, users.Len(), skippedTimeout), false)
+		collectorMetrics.UsersCollected.WithLabelValues(rangeLeaderBoard).Inc()
+		collectorMetrics.UsersRemaining.WithLabelValues(rangeLeaderBoard).Dec()
 		bar.Increment()
 		expBackOff.Reset()
 	}
@@ -304,63 +806,71 @@ func run() {
 		logger.Info("Skipped some due to timeouts", zap.Int("skipped", skippedAccepted))
 	}
 
-	{
-		total := 0
-		for _, val := range users {
-			if val {
-				total += 1
-			}
-		}
-		logger.Info("Total Users Collected", zap.Int("users", total), zap.Int("of", len(users)))
+	logger.Info("Total Users Collected", zap.Int("users", countCollected(users)), zap.Int("of", users.Len()))
+	return nil
+}
+
+// runProgress is the text of the parent message of a run's slack thread
+func runProgress(state, rangeName string, collected, discovered, timeouts int) string {
+	text := fmt.Sprintf("%s: %s, %d of %d users collected", state, rangeName, collected, discovered)
+	if timeouts > 0 {
+		text += fmt.Sprintf(", %d timed out", timeouts)
+	}
+	return text
+}
+
+// recordError counts a failed stats request in the run's summary and keeps it in the store,
+// failing to do so doesn't stop the run
+func recordError(summary *RunSummary, userID, kind string, cause error) {
+	summary.Errors[kind]++
+	if err := store.SaveError(summary.RunID, userID, kind, cause); err != nil {
+		logger.Error("Failed to record error", zap.Error(err))
 	}
 }
 
-func addUsers(leaderboard *leaders.LeaderOK, mapusers map[string]bool, m DiskMappedObject) {
+// newProgressBar returns a progress bar that stays silent when running as a daemon
+func newProgressBar(total int) *pb.ProgressBar {
+	bar := pb.New(total)
+	bar.NotPrint = quietProgress
+	return bar
+}
+
+func addUsers(leaderboard *leaders.LeaderOK, users *PersistentMap[string, bool]) {
 	for _, data := range leaderboard.Payload.Data {
-		m.lock.RLock()
-		_, ok := mapusers[data.User.ID]
-		m.lock.RUnlock()
-		if !ok {
-			m.lock.Lock()
-			mapusers[data.User.ID] = false
-			m.lock.Unlock()
-		}
+		users.Update(data.User.ID, func(collected bool, ok bool) (bool, bool) {
+			return false, !ok
+		})
 	}
 }
 
-func addUsersFromArray(mapusers map[string]bool) {
-	var users []string
-	users = make([]string, 0, 5000)
+func countCollected(users *PersistentMap[string, bool]) int {
+	total := 0
+	users.Range(func(_ string, collected bool) bool {
+		if collected {
+			total += 1
+		}
+		return true
+	})
+	return total
+}
+
+func addUsersFromArray(users *PersistentMap[string, bool]) error {
+	var ids []string
+	ids = make([]string, 0, 5000)
 	if _, err := os.Stat(usersFile); err == nil {
-		if err := Load(usersFile, &users, GlobDecoder); err != nil {
-			panic(err.Error())
+		if _, err := LoadState(usersFile, usersArrayKind, &ids); err != nil {
+			return err
 		}
 	}
-	for _, val := range users {
-		mapusers[val] = false
-	}
+	return users.SetMissing(ids, false)
 }
 
-func writeAllUsers(m map[string]bool) {
-	logger.Sugar().Debug("Total in array ", len(m))
-	users := make([]string, len(m))
-	i := 0
-	for key, _ := range m {
-		users[i] = key
-		i += 1
-	}
-	b, err := GlobEncoder(users)
-	if err != nil {
-		panic(err)
-	}
-	err = writeAtomically(usersFile, func(w io.Writer) error {
-		bb := b.(*bytes.Buffer)
-		_, err := w.Write(bb.Bytes())
-		return err
+func writeAllUsers(users *PersistentMap[string, bool]) error {
+	ids := users.Keys()
+	logger.Sugar().Debug("Total in array ", len(ids))
+	return writeAtomically(usersFile, func(w io.Writer) error {
+		return SaveState(w, usersArrayKind, ids, CodecForPath(usersFile))
 	})
-	if err != nil {
-		panic(err)
-	}
 }
 
 func writeAtomically(dest string, write func(w io.Writer) error) (err error) {
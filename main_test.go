@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidateFlags(t *testing.T) {
+	stale, rate, token, channel, addr, to, from := *lockStale, *slackRate, *slackToken, *slackChannel, *smtpAddr, *emailTo, *emailFrom
+	defer func() {
+		*lockStale, *slackRate, *slackToken, *slackChannel, *smtpAddr, *emailTo, *emailFrom = stale, rate, token, channel, addr, to, from
+	}()
+
+	tests := []struct {
+		name    string
+		set     func()
+		wantErr bool
+	}{
+		{name: "Defaults", set: func() {}},
+		{name: "ZeroLockStale", set: func() { *lockStale = 0 }, wantErr: true},
+		{name: "NegativeSlackRate", set: func() { *slackRate = -1 }, wantErr: true},
+		{name: "NaNSlackRate", set: func() { *slackRate = math.NaN() }, wantErr: true},
+		{name: "TokenWithoutChannel", set: func() { *slackToken = "xoxb-test" }, wantErr: true},
+		{name: "TokenWithChannel", set: func() { *slackToken, *slackChannel = "xoxb-test", "#wakatime" }},
+		{name: "EmailWithoutFrom", set: func() { *smtpAddr, *emailTo = "localhost:25", []string{"ops@example.com"} }, wantErr: true},
+		{name: "SMTPForRoutesOnly", set: func() { *smtpAddr = "localhost:25" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*lockStale, *slackRate, *slackToken, *slackChannel = 2*time.Minute, 1, "", ""
+			*smtpAddr, *emailTo, *emailFrom = "", nil, ""
+			tt.set()
+			if err := validateFlags(); (err != nil) != tt.wantErr {
+				t.Errorf("validateFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRun_RecordsWithoutCacheDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	// the recording is made of a replay so the run stays off the network
+	upstream := filepath.Join(dir, "upstream.jsonl")
+	writeTestRunCassette(t, upstream)
+	replay, err := NewReplayTransport(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, recorded, quiet := http.DefaultTransport, *recordFile, quietProgress
+	defer func() { http.DefaultTransport, *recordFile, quietProgress = transport, recorded, quiet }()
+	http.DefaultTransport, *recordFile, quietProgress = replay, filepath.Join(dir, "run.jsonl"), true
+
+	started := time.Now()
+	// another range than the metrics test so their counters stay apart
+	if err := run(365, started); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{path.Join(".cache-"+started.Format(snapshotDateFormat), "users.tmp"), usersFile, "run.jsonl"} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("recording didn't write %s: %v", name, err)
+		}
+	}
+}
+
+func TestRun_AppendsEveryRunToTheHAR(t *testing.T) {
+	dir, err := ioutil.TempDir("", "har")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	cassette := filepath.Join(dir, "run.jsonl")
+	writeTestRunCassette(t, cassette)
+	replayed, har, quiet := *replayFile, *harFile, quietProgress
+	defer func() { *replayFile, *harFile, quietProgress = replayed, har, quiet }()
+	*replayFile, *harFile, quietProgress = cassette, filepath.Join(dir, "runs.har"), true
+	defer func() {
+		closeHAR()
+		harRecorder = nil
+	}()
+
+	// like serve, which runs the schedule in one process
+	for i := 0; i < 2; i++ {
+		if err := run(180, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw, err := ioutil.ReadFile(*harFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc HAR
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		t.Fatal(err)
+	}
+	// each run makes 7 requests
+	if len(doc.Log.Entries) != 14 {
+		t.Errorf("HAR holds %d entries, want those of both runs", len(doc.Log.Entries))
+	}
+}
+
+func TestOpenStore_ReplayStaysInMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	replayed, database := *replayFile, *databaseFile
+	defer func() { *replayFile, *databaseFile = replayed, database }()
+	*replayFile, *databaseFile = filepath.Join(dir, "run.jsonl"), filepath.Join(dir, "wakatime.db")
+
+	s, err := openStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.StartRun("last_7_days", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("a replay wrote %d files, want the database left alone", len(files))
+	}
+}
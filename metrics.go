@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+)
+
+const metricsNamespace = "wakatime_collector"
+
+const (
+	cacheHit        = "hit"
+	cacheMiss       = "miss"
+	cacheRevalidate = "revalidate"
+	cacheBypass     = "bypass"
+)
+
+// metricsRegistry holds every metric the collector records
+var metricsRegistry = prometheus.NewRegistry()
+
+// TransportMetrics are recorded by Transport for every request it handles
+type TransportMetrics struct {
+	CacheLookups    *prometheus.CounterVec
+	UpstreamLatency *prometheus.HistogramVec
+	BytesReceived   *prometheus.CounterVec
+	Responses       *prometheus.CounterVec
+}
+
+// NewTransportMetrics creates the transport metrics and registers them with reg
+func NewTransportMetrics(reg prometheus.Registerer) *TransportMetrics {
+	m := &TransportMetrics{
+		CacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "cache_lookups_total",
+			Help:      "Cache lookups by result: hit, miss, revalidate or bypass.",
+		}, []string{"endpoint", "result"}),
+		UpstreamLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "upstream_latency_seconds",
+			Help:      "Time until response headers were received from the WakaTime API.",
+			Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		}, []string{"endpoint"}),
+		BytesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "response_bytes_total",
+			Help:      "Response body bytes read, by endpoint and whether they came from the cache or upstream.",
+		}, []string{"endpoint", "source"}),
+		Responses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "responses_total",
+			Help:      "Responses by endpoint, status code and source.",
+		}, []string{"endpoint", "code", "source"}),
+	}
+	reg.MustRegister(m.CacheLookups, m.UpstreamLatency, m.BytesReceived, m.Responses)
+	return m
+}
+
+// endpointLabel collapses user ids out of a request path to keep label cardinality bounded
+func endpointLabel(u *url.URL) string {
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := 1; i < len(parts); i++ {
+		if parts[i-1] == "users" && parts[i] != "current" {
+			parts[i] = ":user"
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+func responseSource(resp *http.Response) string {
+	if resp.Header.Get(XFromCache) != "" {
+		return "cache"
+	}
+	return "upstream"
+}
+
+// countResponse records the response and counts its body bytes as they are read
+func (m *TransportMetrics) countResponse(endpoint string, resp *http.Response) {
+	if m == nil || resp == nil {
+		return
+	}
+	source := responseSource(resp)
+	m.Responses.WithLabelValues(endpoint, fmt.Sprint(resp.StatusCode), source).Inc()
+	if resp.Body != nil {
+		resp.Body = &countingReadCloser{ReadCloser: resp.Body, counter: m.BytesReceived.WithLabelValues(endpoint, source)}
+	}
+}
+
+func (m *TransportMetrics) cacheLookup(endpoint, result string) {
+	if m == nil {
+		return
+	}
+	m.CacheLookups.WithLabelValues(endpoint, result).Inc()
+}
+
+func (m *TransportMetrics) observeLatency(endpoint string, seconds float64) {
+	if m == nil {
+		return
+	}
+	m.UpstreamLatency.WithLabelValues(endpoint).Observe(seconds)
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	counter prometheus.Counter
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 {
+		c.counter.Add(float64(n))
+	}
+	return n, err
+}
+
+// WriteMetricsSummary writes a short human readable summary of every metric in g
+func WriteMetricsSummary(w io.Writer, g prometheus.Gatherer) error {
+	families, err := g.Gather()
+	if err != nil {
+		return err
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			name := family.GetName() + formatLabels(metric.GetLabel())
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				_, err = fmt.Fprintf(w, "%s %g\n", name, metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				_, err = fmt.Fprintf(w, "%s %g\n", name, metric.GetGauge().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := metric.GetHistogram()
+				mean := 0.0
+				if h.GetSampleCount() > 0 {
+					mean = h.GetSampleSum() / float64(h.GetSampleCount())
+				}
+				_, err = fmt.Fprintf(w, "%s count=%d mean=%.3f\n", name, h.GetSampleCount(), mean)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func formatLabels(labels []*dto.LabelPair) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels))
+	for _, label := range labels {
+		pairs = append(pairs, label.GetName()+"="+label.GetValue())
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// logMetrics logs a summary of the collected metrics at debug level
+func logMetrics() {
+	b := new(bytes.Buffer)
+	if err := WriteMetricsSummary(b, metricsRegistry); err != nil {
+		logger.Error("Failed to gather metrics", zap.Error(err))
+		return
+	}
+	logger.Debug("Metrics\n" + b.String())
+}
+
+// CollectorMetrics track the progress of collection runs, labelled by leader board range
+type CollectorMetrics struct {
+	UsersDiscovered *prometheus.GaugeVec
+	UsersCollected  *prometheus.GaugeVec
+	UsersRemaining  *prometheus.GaugeVec
+	UsersSkipped    *prometheus.CounterVec
+	Errors          *prometheus.CounterVec
+	RateLimited     *prometheus.CounterVec
+	BackoffSeconds  *prometheus.CounterVec
+	Runs            *prometheus.CounterVec
+	LastSuccess     *prometheus.GaugeVec
+}
+
+// NewCollectorMetrics creates the collector metrics and registers them with reg
+func NewCollectorMetrics(reg prometheus.Registerer) *CollectorMetrics {
+	gauge := func(name, help string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      name,
+			Help:      help,
+		}, []string{"range"})
+	}
+	counter := func(name, help string, labels ...string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      name,
+			Help:      help,
+		}, append([]string{"range"}, labels...))
+	}
+	m := &CollectorMetrics{
+		UsersDiscovered: gauge("users_discovered", "Users found on the leader board."),
+		UsersCollected:  gauge("users_collected", "Users whose stats have been collected."),
+		UsersRemaining:  gauge("users_remaining", "Users still waiting to be collected."),
+		UsersSkipped:    counter("users_skipped_total", "Users skipped by reason: accepted, timeout or not_found.", "reason"),
+		Errors:          counter("errors_total", "Unexpected errors while collecting user stats."),
+		RateLimited:     counter("rate_limited_total", "Responses with status 429."),
+		BackoffSeconds:  counter("backoff_seconds_total", "Time spent backing off after being rate limited."),
+		Runs:            counter("runs_total", "Finished collection runs by result.", "result"),
+		LastSuccess:     gauge("last_success_timestamp_seconds", "Unix time the last collection run finished successfully."),
+	}
+	reg.MustRegister(m.UsersDiscovered, m.UsersCollected, m.UsersRemaining, m.UsersSkipped,
+		m.Errors, m.RateLimited, m.BackoffSeconds, m.Runs, m.LastSuccess)
+	return m
+}
+
+// finishRun records the outcome of a run, err points at the run's named return value
+func (m *CollectorMetrics) finishRun(rangeLeaderBoard string, err *error) {
+	if *err != nil {
+		m.Runs.WithLabelValues(rangeLeaderBoard, "failure").Inc()
+		return
+	}
+	m.Runs.WithLabelValues(rangeLeaderBoard, "success").Inc()
+	m.LastSuccess.WithLabelValues(rangeLeaderBoard).SetToCurrentTime()
+}
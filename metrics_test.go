@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gregjones/httpcache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_endpointLabel(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/api/v1/users/current", want: "/api/v1/users/current"},
+		{path: "/api/v1/users/abc-123/stats", want: "/api/v1/users/:user/stats"},
+		{path: "/api/v1/leaders", want: "/api/v1/leaders"},
+	}
+	for _, tt := range tests {
+		if got := endpointLabel(&url.URL{Path: tt.path}); got != tt.want {
+			t.Errorf("endpointLabel(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestTransport_Metrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer server.Close()
+
+	reg := prometheus.NewRegistry()
+	metrics := NewTransportMetrics(reg)
+	cache := httpcache.NewMemoryCache()
+	tp := NewHeuristicTransport(cache)
+	tp.Metrics = metrics
+
+	stale := server.URL + "/api/v1/users/someone/stats"
+	cache.Set("GET "+stale, []byte("HTTP/1.1 200 OK\r\nCache-Control: public\r\nExpires: "+
+		time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)+"\r\nContent-Length: 2\r\n\r\n{}"))
+
+	client := &http.Client{Transport: tp}
+	for _, u := range []string{server.URL + "/api/v1/leaders", server.URL + "/api/v1/leaders", stale} {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	tests := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{name: "miss", got: testutil.ToFloat64(metrics.CacheLookups.WithLabelValues("/api/v1/leaders", cacheMiss)), want: 1},
+		{name: "hit", got: testutil.ToFloat64(metrics.CacheLookups.WithLabelValues("/api/v1/leaders", cacheHit)), want: 1},
+		{name: "revalidate", got: testutil.ToFloat64(metrics.CacheLookups.WithLabelValues("/api/v1/users/:user/stats", cacheRevalidate)), want: 1},
+		{name: "upstream bytes", got: testutil.ToFloat64(metrics.BytesReceived.WithLabelValues("/api/v1/leaders", "upstream")), want: 5},
+		{name: "cache bytes", got: testutil.ToFloat64(metrics.BytesReceived.WithLabelValues("/api/v1/leaders", "cache")), want: 5},
+		{name: "200 upstream", got: testutil.ToFloat64(metrics.Responses.WithLabelValues("/api/v1/leaders", "200", "upstream")), want: 1},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	b := new(bytes.Buffer)
+	if err := WriteMetricsSummary(b, reg); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "wakatime_collector_http_upstream_latency_seconds{endpoint=/api/v1/leaders} count=1") {
+		t.Errorf("unexpected summary:\n%s", b)
+	}
+}
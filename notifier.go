@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/joomcode/errorx"
+	"go.uber.org/zap/zapcore"
+)
+
+// notifyMaxRateLimited is how many 429 responses a message may get before it is given up on
+const notifyMaxRateLimited = 5
+
+var (
+	notifyNamespace   = errorx.NewNamespace("notify")
+	NotifyPostFailed  = notifyNamespace.NewType("post_failed")
+	NotifyRateLimited = notifyNamespace.NewType("rate_limited")
+	// NotifyRejected is a 4xx other than 429, posting the same message again won't help
+	NotifyRejected  = notifyNamespace.NewType("rejected")
+	NotifyClosed    = notifyNamespace.NewType("closed")
+	NotifyQueueFull = notifyNamespace.NewType("queue_full")
+
+	retryAfterProperty = errorx.RegisterProperty("retry_after")
+)
+
+// Notifier is a zap core delivering log entries somewhere people look, besides run summaries
+type Notifier interface {
+	zapcore.Core
+	RunNotifier
+	// Close delivers what is still queued until ctx is done
+	Close(ctx context.Context) error
+}
+
+// NotifierSink renders and delivers to one service, a NotifierCore queues and retries for it
+type NotifierSink interface {
+	// SendEntry delivers entry, fields holds the entry's fields and those added by With
+	SendEntry(entry zapcore.Entry, fields map[string]interface{}) error
+	SendRun(summary *RunSummary) error
+}
+
+// NotifierCore is a zap core handing entries at or above its level to a sink from a worker,
+// retrying failed deliveries with backoff
+type NotifierCore struct {
+	Name  string
+	Level zapcore.Level
+	sink  NotifierSink
+	// RetryFor is how long a failing delivery is retried with exponential backoff
+	RetryFor time.Duration
+	// limiter spaces out deliveries
+	limiter *tokenBucket
+
+	fields []zapcore.Field
+	queue  *notifyQueue[func() error]
+}
+
+// notifyQueue holds what waits for a notifier's worker, it is shared by a core and its clones
+type notifyQueue[T any] struct {
+	items chan T
+	start sync.Once
+	quit  chan struct{}
+	done  chan struct{}
+
+	// pending counts the items queued and not handled yet, idle is broadcast when it drops to zero.
+	// Items are queued while others wait for the count to drop, which a WaitGroup doesn't allow.
+	pendingLock sync.Mutex
+	idle        *sync.Cond
+	pending     int
+
+	// lock keeps items from being queued once Close has started draining
+	lock   sync.RWMutex
+	closed bool
+
+	totalErrors int64
+}
+
+func newNotifyQueue[T any](size int) *notifyQueue[T] {
+	q := &notifyQueue[T]{
+		items: make(chan T, size),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	q.idle = sync.NewCond(&q.pendingLock)
+	return q
+}
+
+// add changes the count of pending items by delta
+func (q *notifyQueue[T]) add(delta int) {
+	q.pendingLock.Lock()
+	defer q.pendingLock.Unlock()
+	q.pending += delta
+	if q.pending == 0 {
+		q.idle.Broadcast()
+	}
+}
+
+// wait returns once no item is pending
+func (q *notifyQueue[T]) wait() {
+	q.pendingLock.Lock()
+	defer q.pendingLock.Unlock()
+	for q.pending > 0 {
+		q.idle.Wait()
+	}
+}
+
+// push hands item to the worker, which is started the first time. It never waits for the
+// worker, failing with NotifyQueueFull when it is too far behind and NotifyClosed once closed.
+func (q *notifyQueue[T]) push(item T, worker func()) error {
+	q.start.Do(func() {
+		go worker()
+	})
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if q.closed {
+		return NotifyClosed.New("not queueing after close")
+	}
+	q.add(1)
+	select {
+	case q.items <- item:
+		return nil
+	default:
+		q.add(-1)
+		atomic.AddInt64(&q.totalErrors, 1)
+		return NotifyQueueFull.New("%d entries are waiting to be delivered", cap(q.items))
+	}
+}
+
+// close stops queueing and waits for the queued items and then for idle to return, until ctx
+// is done. The worker is stopped either way and the items it didn't get to are returned with
+// the error of ctx, the worker then isn't waited for and may outlive close while it finishes
+// the delivery it is making. It returns false when the queue was closed already.
+func (q *notifyQueue[T]) close(ctx context.Context, worker func(), idle func()) ([]T, bool, error) {
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return nil, false, nil
+	}
+	q.closed = true
+	q.lock.Unlock()
+
+	q.start.Do(func() {
+		go worker()
+	})
+	drained := make(chan struct{})
+	go func() {
+		q.wait()
+		idle()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		close(q.quit)
+		<-q.done
+		return nil, true, nil
+	case <-ctx.Done():
+	}
+
+	close(q.quit)
+	var left []T
+	for {
+		select {
+		case item := <-q.items:
+			left = append(left, item)
+			q.add(-1)
+		default:
+			return left, true, ctx.Err()
+		}
+	}
+}
+
+func NewNotifierCore(name string, sink NotifierSink, level zapcore.Level) *NotifierCore {
+	return &NotifierCore{
+		Name:     name,
+		Level:    level,
+		sink:     sink,
+		RetryFor: time.Minute,
+		limiter:  newTokenBucket(1, 5),
+		queue:    newNotifyQueue[func() error](100),
+	}
+}
+
+func (n *NotifierCore) Enabled(lvl zapcore.Level) bool {
+	return n.Level.Enabled(lvl)
+}
+
+func (n *NotifierCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *n
+	clone.fields = append(n.fields[:len(n.fields):len(n.fields)], fields...)
+	return &clone
+}
+
+func (n *NotifierCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if n.Enabled(entry.Level) {
+		return checked.AddCore(entry, n)
+	}
+	return checked
+}
+
+// Write queues entry, fatal entries are delivered right away once the queue was
+func (n *NotifierCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, field := range n.fields {
+		field.AddTo(enc)
+	}
+	for _, field := range fields {
+		field.AddTo(enc)
+	}
+	job := func() error {
+		return n.sink.SendEntry(entry, enc.Fields)
+	}
+	if entry.Level >= zapcore.FatalLevel {
+		n.queue.wait()
+		return n.deliver(job)
+	}
+	return n.enqueue(job)
+}
+
+// NotifyRun delivers summary once the queued entries were
+func (n *NotifierCore) NotifyRun(summary *RunSummary) error {
+	n.queue.wait()
+	return n.deliver(func() error {
+		return n.sink.SendRun(summary)
+	})
+}
+
+// Sync waits for queued entries to be delivered
+func (n *NotifierCore) Sync() error {
+	n.queue.wait()
+	return nil
+}
+
+// enqueue hands job to the worker, it is dropped when the worker is too far behind
+// so logging never waits on a slow service
+func (n *NotifierCore) enqueue(job func() error) error {
+	if err := n.queue.push(job, n.startWorker); err != nil {
+		return errorx.Decorate(err, "%s", n.Name)
+	}
+	return nil
+}
+
+func (n *NotifierCore) startWorker() {
+	q := n.queue
+	defer close(q.done)
+	for {
+		select {
+		case job := <-q.items:
+			n.deliver(job)
+			q.add(-1)
+		case <-q.quit:
+			return
+		}
+	}
+}
+
+// deliver runs job once the rate limit allows, retrying it until it succeeds, is rejected or RetryFor has passed
+func (n *NotifierCore) deliver(job func() error) error {
+	err := retryDelivery(n.RetryFor, func() error {
+		return withRateLimit(n.limiter, job)
+	})
+	if err != nil {
+		atomic.AddInt64(&n.queue.totalErrors, 1)
+		return errorx.Decorate(err, "failed to notify %s", n.Name)
+	}
+	return nil
+}
+
+// Close stops queueing entries and waits for the queued ones to be delivered until ctx is done,
+// those still queued by then are dropped
+func (n *NotifierCore) Close(ctx context.Context) error {
+	left, _, err := n.queue.close(ctx, n.startWorker, func() {})
+	if err != nil {
+		return errorx.Decorate(err, "closed %s with %d entries still queued", n.Name, len(left))
+	}
+	return nil
+}
+
+// retryDelivery calls deliver until it succeeds, is rejected or retryFor has passed
+func retryDelivery(retryFor time.Duration, deliver func() error) error {
+	if retryFor <= 0 {
+		return deliver()
+	}
+	expBackOff := backoff.NewExponentialBackOff()
+	expBackOff.InitialInterval = 500 * time.Millisecond
+	expBackOff.MaxElapsedTime = retryFor
+	return backoff.Retry(func() error {
+		err := deliver()
+		if errorx.IsOfType(err, NotifyRejected) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}, expBackOff)
+}
+
+// withRateLimit calls post once limiter allows, waiting out any Retry-After the service answers with
+func withRateLimit(limiter *tokenBucket, post func() error) error {
+	var err error
+	for attempt := 0; attempt < notifyMaxRateLimited; attempt++ {
+		if limiter != nil {
+			limiter.Wait()
+		}
+		err = post()
+		if !errorx.IsOfType(err, NotifyRateLimited) {
+			return err
+		}
+		retryAfter, _ := errorx.Cast(err).Property(retryAfterProperty)
+		if limiter != nil {
+			limiter.Pause(retryAfter.(time.Duration))
+		} else {
+			time.Sleep(retryAfter.(time.Duration))
+		}
+	}
+	return err
+}
+
+// postJSON posts body to url. A 429 response is returned as NotifyRateLimited with how long
+// to wait as its retry_after property, any other 4xx as NotifyRejected.
+func postJSON(client *http.Client, target string, body []byte) error {
+	resp, err := client.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return NotifyPostFailed.Wrap(err, "failed to post to %s", webhookHost(target))
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	return statusError(resp)
+}
+
+// statusError classifies an unsuccessful response
+func statusError(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return NotifyRateLimited.New(resp.Status).WithProperty(retryAfterProperty, parseRetryAfter(resp.Header.Get("Retry-After")))
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return NotifyRejected.New(resp.Status)
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return NotifyPostFailed.New(resp.Status)
+	}
+	return nil
+}
+
+// webhookHost keeps the secret path of a webhook URL out of errors
+func webhookHost(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "webhook"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// parseRetryAfter reads a Retry-After header in seconds, defaulting to a second
+func parseRetryAfter(header string) time.Duration {
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds < 0 {
+		return time.Second
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// levelHexColors follows the colors of LevelColorMap for services that want them spelled out
+var levelHexColors = map[zapcore.Level]string{
+	zapcore.DebugLevel:  "9B30FF",
+	zapcore.InfoLevel:   "2EB886",
+	zapcore.WarnLevel:   "DAA038",
+	zapcore.ErrorLevel:  "A30200",
+	zapcore.DPanicLevel: "A30200",
+	zapcore.PanicLevel:  "A30200",
+	zapcore.FatalLevel:  "A30200",
+}
+
+// summaryColor is green for a successful run and red otherwise
+func summaryColor(summary *RunSummary) string {
+	if summary.Result == runSucceeded {
+		return levelHexColors[zapcore.InfoLevel]
+	}
+	return levelHexColors[zapcore.ErrorLevel]
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"go.uber.org/zap/zapcore"
+)
+
+// Discord embed limits
+const (
+	discordTitleLimit       = 256
+	discordDescriptionLimit = 4096
+	discordMaxFields        = 25
+	discordFieldLimit       = 1024
+)
+
+// DiscordSink posts embeds to a Discord webhook
+type DiscordSink struct {
+	URL    string
+	client *http.Client
+}
+
+func NewDiscordSink(url string, timeout time.Duration) *DiscordSink {
+	return &DiscordSink{URL: url, client: &http.Client{Timeout: timeout}}
+}
+
+type discordMessage struct {
+	Embeds []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title       string         `json:"title"`
+	Description string         `json:"description,omitempty"`
+	Color       int            `json:"color"`
+	Fields      []discordField `json:"fields,omitempty"`
+	Footer      *discordFooter `json:"footer,omitempty"`
+	Timestamp   string         `json:"timestamp,omitempty"`
+}
+
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordFooter struct {
+	Text string `json:"text"`
+}
+
+// SendEntry posts the message as the title, fields inline and the caller and stack as the description
+func (d *DiscordSink) SendEntry(entry zapcore.Entry, fields map[string]interface{}) error {
+	embed := discordEmbed{
+		Title:     truncate(entry.Message, discordTitleLimit),
+		Color:     hexColor(levelHexColors[entry.Level]),
+		Timestamp: entry.Time.UTC().Format(time.RFC3339),
+	}
+	var description string
+	if entry.Caller.Defined {
+		description += fmt.Sprintf("**caller**\n```%s```\n", entry.Caller.TrimmedPath())
+	}
+	if entry.Stack != "" {
+		description += fmt.Sprintf("**stack**\n```%s```", entry.Stack)
+	}
+	embed.Description = truncate(description, discordDescriptionLimit)
+	for _, key := range sortedKeys(fields) {
+		if len(embed.Fields) == discordMaxFields {
+			break
+		}
+		embed.Fields = append(embed.Fields, discordField{Name: key, Value: truncate(fieldText(fields[key]), discordFieldLimit), Inline: true})
+	}
+	if entry.LoggerName != "" {
+		embed.Footer = &discordFooter{Text: entry.LoggerName}
+	}
+	return d.post(discordMessage{Embeds: []discordEmbed{embed}})
+}
+
+func (d *DiscordSink) SendRun(summary *RunSummary) error {
+	embed := discordEmbed{
+		Title:       truncate(summary.Title(), discordTitleLimit),
+		Description: truncate(summary.Error, discordDescriptionLimit),
+		Color:       hexColor(summaryColor(summary)),
+		Timestamp:   summary.Finished.UTC().Format(time.RFC3339),
+	}
+	for _, fact := range summaryFacts(summary) {
+		embed.Fields = append(embed.Fields, discordField{Name: fact[0], Value: fact[1], Inline: true})
+	}
+	if comparison := summary.Comparison(); comparison != "" {
+		embed.Footer = &discordFooter{Text: comparison}
+	}
+	return d.post(discordMessage{Embeds: []discordEmbed{embed}})
+}
+
+func (d *DiscordSink) post(message discordMessage) error {
+	raw, err := json.Marshal(message)
+	if err != nil {
+		return errorx.Decorate(err, "marshal failed")
+	}
+	return postJSON(d.client, d.URL, raw)
+}
+
+// hexColor reads a color like A30200 as the number Discord wants
+func hexColor(hex string) int {
+	color, _ := strconv.ParseInt(hex, 16, 32)
+	return int(color)
+}
+
+// sortedKeys returns the keys of fields in order so messages are laid out the same every time
+func sortedKeys(fields map[string]interface{}) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// summaryFacts are the numbers of a run summary as name, value pairs
+func summaryFacts(summary *RunSummary) [][2]string {
+	return [][2]string{
+		{"duration", shortDuration(summary.Duration())},
+		{"throughput", fmt.Sprintf("%.1f users/min", summary.Throughput())},
+		{"collected this run", strconv.Itoa(summary.CollectedThisRun)},
+		{"collected", fmt.Sprintf("%d of %d, %d remaining", summary.Collected, summary.Discovered, summary.Remaining())},
+		{"errors", summary.ErrorBreakdown()},
+	}
+}
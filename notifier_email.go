@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// EmailSink mails entries through an SMTP server
+type EmailSink struct {
+	Addr string // host:port
+	From string
+	To   []string
+	auth smtp.Auth
+	// Timeout bounds connecting to the server and the whole conversation after
+	Timeout time.Duration
+
+	// send is sendMail, replaced in tests
+	send func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// NewEmailSink authenticates with username and password when a username is given
+func NewEmailSink(addr, username, password, from string, to []string, timeout time.Duration) *EmailSink {
+	sink := &EmailSink{Addr: addr, From: from, To: to, Timeout: timeout}
+	sink.send = sink.sendMail
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		sink.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return sink
+}
+
+func (e *EmailSink) SendEntry(entry zapcore.Entry, fields map[string]interface{}) error {
+	var body strings.Builder
+	fmt.Fprintf(&body, "%s\n\n", entry.Message)
+	for _, key := range sortedKeys(fields) {
+		fmt.Fprintf(&body, "%s: %s\n", key, fieldText(fields[key]))
+	}
+	if entry.Caller.Defined {
+		fmt.Fprintf(&body, "\ncaller: %s\n", entry.Caller.TrimmedPath())
+	}
+	if entry.Stack != "" {
+		fmt.Fprintf(&body, "\n%s\n", entry.Stack)
+	}
+	return e.mail(fmt.Sprintf("[%s] %s", entry.Level.CapitalString(), entry.Message), entry.Time, body.String())
+}
+
+func (e *EmailSink) SendRun(summary *RunSummary) error {
+	return e.mail(summary.Title(), summary.Finished, summary.Report())
+}
+
+// mail sends a plain text message, permanent SMTP errors are returned as NotifyRejected
+func (e *EmailSink) mail(subject string, date time.Time, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	err := e.send(e.Addr, e.auth, e.From, e.To, msg.Bytes())
+	if protocolErr, ok := err.(*textproto.Error); ok && protocolErr.Code >= 500 {
+		return NotifyRejected.Wrap(err, "mail to %s refused", strings.Join(e.To, ", "))
+	}
+	if err != nil {
+		return NotifyPostFailed.Wrap(err, "failed to mail %s", strings.Join(e.To, ", "))
+	}
+	return nil
+}
+
+// sendMail works like smtp.SendMail but gives up once Timeout has passed
+func (e *EmailSink) sendMail(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", addr, e.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(e.Timeout)); err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if a != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(a); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"go.uber.org/zap/zapcore"
+)
+
+// TeamsSink posts message cards to a Microsoft Teams incoming webhook
+type TeamsSink struct {
+	URL    string
+	client *http.Client
+}
+
+func NewTeamsSink(url string, timeout time.Duration) *TeamsSink {
+	return &TeamsSink{URL: url, client: &http.Client{Timeout: timeout}}
+}
+
+type teamsCard struct {
+	Type       string         `json:"@type"`
+	Context    string         `json:"@context"`
+	ThemeColor string         `json:"themeColor"`
+	Summary    string         `json:"summary"`
+	Title      string         `json:"title"`
+	Sections   []teamsSection `json:"sections,omitempty"`
+}
+
+type teamsSection struct {
+	Text     string      `json:"text,omitempty"`
+	Facts    []teamsFact `json:"facts,omitempty"`
+	Markdown bool        `json:"markdown"`
+}
+
+type teamsFact struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func newTeamsCard(title, color string) teamsCard {
+	return teamsCard{
+		Type:       "MessageCard",
+		Context:    "https://schema.org/extensions",
+		ThemeColor: color,
+		Summary:    title,
+		Title:      title,
+	}
+}
+
+// SendEntry posts the message as the card title, fields as facts and the caller and stack as text
+func (t *TeamsSink) SendEntry(entry zapcore.Entry, fields map[string]interface{}) error {
+	card := newTeamsCard(entry.Message, levelHexColors[entry.Level])
+	section := teamsSection{Markdown: true}
+	for _, key := range sortedKeys(fields) {
+		section.Facts = append(section.Facts, teamsFact{Name: key, Value: fieldText(fields[key])})
+	}
+	if entry.Caller.Defined {
+		section.Text += fmt.Sprintf("**caller** `%s`\n\n", entry.Caller.TrimmedPath())
+	}
+	if entry.Stack != "" {
+		section.Text += fmt.Sprintf("**stack**\n\n<pre>%s</pre>", entry.Stack)
+	}
+	card.Sections = []teamsSection{section}
+	return t.post(card)
+}
+
+func (t *TeamsSink) SendRun(summary *RunSummary) error {
+	card := newTeamsCard(summary.Title(), summaryColor(summary))
+	section := teamsSection{Text: summary.Error, Markdown: true}
+	for _, fact := range summaryFacts(summary) {
+		section.Facts = append(section.Facts, teamsFact{Name: fact[0], Value: fact[1]})
+	}
+	card.Sections = []teamsSection{section}
+	if comparison := summary.Comparison(); comparison != "" {
+		card.Sections = append(card.Sections, teamsSection{Text: comparison})
+	}
+	return t.post(card)
+}
+
+func (t *TeamsSink) post(card teamsCard) error {
+	raw, err := json.Marshal(card)
+	if err != nil {
+		return errorx.Decorate(err, "marshal failed")
+	}
+	return postJSON(t.client, t.URL, raw)
+}
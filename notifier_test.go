@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestNotifiers_CheckNotifierInterface(t *testing.T) {
+	var _ Notifier = &SlackCore{}
+	var _ Notifier = &NotifierCore{}
+}
+
+// recordingServer records the requests made to it. The first ones are answered with the
+// statuses in fail without being recorded, the recorded ones by reply or with an empty 200.
+type recordingServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	requests []recordedRequest
+	fail     []int
+	reply    func(w http.ResponseWriter, r *http.Request, n int)
+}
+
+type recordedRequest struct {
+	Path string
+	Body []byte
+}
+
+func newRecordingServer(fail ...int) *recordingServer {
+	s := &recordingServer{fail: fail}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		if len(s.fail) > 0 {
+			status := s.fail[0]
+			s.fail = s.fail[1:]
+			s.lock.Unlock()
+			// rate limited requests may be retried right away
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(status)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		s.requests = append(s.requests, recordedRequest{strings.TrimPrefix(r.URL.Path, "/"), body})
+		n, reply := len(s.requests), s.reply
+		s.lock.Unlock()
+		if reply != nil {
+			reply(w, r, n)
+		}
+	}))
+	return s
+}
+
+func (s *recordingServer) Requests() []recordedRequest {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]recordedRequest(nil), s.requests...)
+}
+
+func (s *recordingServer) Bodies() []string {
+	var bodies []string
+	for _, request := range s.Requests() {
+		bodies = append(bodies, string(request.Body))
+	}
+	return bodies
+}
+
+func testRunSummary() *RunSummary {
+	started := time.Date(2019, 1, 2, 12, 0, 0, 0, time.UTC)
+	return &RunSummary{
+		RunID: 2, Range: "last_7_days", Host: "node-1", Started: started, Finished: started.Add(10 * time.Minute),
+		Result: runSucceeded, Discovered: 500, Collected: 480, CollectedThisRun: 300,
+		Errors: map[string]int{"timeout": 3},
+	}
+}
+
+func TestNotifierSinks(t *testing.T) {
+	entry := zapcore.Entry{Level: zapcore.ErrorLevel, Message: "fetch failed", LoggerName: "collector", Time: time.Date(2019, 1, 2, 12, 0, 0, 0, time.UTC)}
+	fields := map[string]interface{}{"user": "alice", "status": 500}
+	webhook, err := NewWebhookSink("", `{"text":{{json .Message}},"user":{{json .Fields.user}}}`, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		sink  func(url string) NotifierSink
+		entry []string
+		run   []string
+	}{
+		{
+			name:  "discord",
+			sink:  func(url string) NotifierSink { return NewDiscordSink(url, time.Second) },
+			entry: []string{`"title":"fetch failed"`, `"color":10682880`, `{"name":"user","value":"alice","inline":true}`, `"footer":{"text":"collector"}`},
+			run:   []string{`"title":"Run finished: last_7_days on node-1"`, `"color":3061894`, `"value":"3 timeout"`},
+		},
+		{
+			name:  "teams",
+			sink:  func(url string) NotifierSink { return NewTeamsSink(url, time.Second) },
+			entry: []string{`"@type":"MessageCard"`, `"themeColor":"A30200"`, `"title":"fetch failed"`, `{"name":"status","value":"500"}`},
+			run:   []string{`"title":"Run finished: last_7_days on node-1"`, `"themeColor":"2EB886"`, `{"name":"collected","value":"480 of 500, 20 remaining"}`},
+		},
+		{
+			name: "webhook",
+			sink: func(url string) NotifierSink {
+				sink := *webhook
+				sink.URL = url
+				return &sink
+			},
+			entry: []string{`{"text":"fetch failed","user":"alice"}`},
+			run:   []string{`{"text":"Run finished: last_7_days on node-1","user":null}`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newRecordingServer()
+			defer server.Close()
+			sink := tt.sink(server.URL)
+			if err := sink.SendEntry(entry, fields); err != nil {
+				t.Fatal(err)
+			}
+			if err := sink.SendRun(testRunSummary()); err != nil {
+				t.Fatal(err)
+			}
+			bodies := server.Bodies()
+			if len(bodies) != 2 {
+				t.Fatalf("got %d posts, want 2", len(bodies))
+			}
+			for i, want := range [][]string{tt.entry, tt.run} {
+				if !json.Valid([]byte(bodies[i])) {
+					t.Errorf("post %d isn't JSON: %s", i, bodies[i])
+				}
+				for _, part := range want {
+					if !strings.Contains(bodies[i], part) {
+						t.Errorf("post %d = %s, want it to contain %s", i, bodies[i], part)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookSink_DefaultTemplate(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+	sink, err := NewWebhookSink(server.URL, "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := zapcore.Entry{Level: zapcore.WarnLevel, Message: "slow \"response\"", Time: time.Date(2019, 1, 2, 12, 0, 0, 0, time.UTC)}
+	if err := sink.SendEntry(entry, map[string]interface{}{"took": "3s"}); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(server.Bodies()[0]), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"kind": "entry", "level": "warn", "message": `slow "response"`, "time": "2019-01-02T12:00:00Z",
+		"fields": map[string]interface{}{"took": "3s"},
+	}
+	if gotJSON, wantJSON := toJSONString(t, got), toJSONString(t, want); gotJSON != wantJSON {
+		t.Errorf("body = %s, want %s", gotJSON, wantJSON)
+	}
+}
+
+func TestWebhookSink_Errors(t *testing.T) {
+	if _, err := NewWebhookSink("", "{{.Missing", time.Second); !errorx.IsOfType(err, errorx.IllegalArgument) {
+		t.Errorf("parsing a bad template = %v, want IllegalArgument", err)
+	}
+	sink, err := NewWebhookSink("http://127.0.0.1:1", `{"text":{{.Message}}}`, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.SendEntry(zapcore.Entry{Message: "not quoted"}, nil); !errorx.IsOfType(err, NotifyRejected) {
+		t.Errorf("rendering invalid JSON = %v, want NotifyRejected", err)
+	}
+}
+
+func TestEmailSink(t *testing.T) {
+	tests := []struct {
+		name    string
+		sendErr error
+		errType *errorx.Type
+	}{
+		{name: "sent"},
+		{name: "refused", sendErr: &textproto.Error{Code: 550, Msg: "no such user"}, errType: NotifyRejected},
+		{name: "unavailable", sendErr: &textproto.Error{Code: 421, Msg: "try again later"}, errType: NotifyPostFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := NewEmailSink("mail.example.com:587", "bot", "secret", "bot@example.com", []string{"ops@example.com", "dev@example.com"}, time.Second)
+			var sent []byte
+			sink.send = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+				if addr != "mail.example.com:587" || a == nil || from != "bot@example.com" || len(to) != 2 {
+					t.Errorf("send(%s, %v, %s, %v)", addr, a, from, to)
+				}
+				sent = msg
+				return tt.sendErr
+			}
+			err := sink.SendEntry(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "fetch failed", Time: time.Now()}, map[string]interface{}{"user": "alice"})
+			if tt.errType != nil {
+				if !errorx.IsOfType(err, tt.errType) {
+					t.Errorf("SendEntry() = %v, want %s", err, tt.errType.FullName())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range []string{"To: ops@example.com, dev@example.com\r\n", "Subject: [ERROR] fetch failed\r\n", "\r\n\r\nfetch failed\r\n\r\nuser: alice\r\n"} {
+				if !strings.Contains(string(sent), want) {
+					t.Errorf("mail = %q, want it to contain %q", sent, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEmailSink_Timeout(t *testing.T) {
+	// a server that accepts connections but never greets
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	sink := NewEmailSink(listener.Addr().String(), "", "", "bot@example.com", []string{"ops@example.com"}, 100*time.Millisecond)
+	done := make(chan error)
+	go func() {
+		done <- sink.SendEntry(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "fetch failed", Time: time.Now()}, nil)
+	}()
+	select {
+	case err := <-done:
+		if !errorx.IsOfType(err, NotifyPostFailed) {
+			t.Errorf("SendEntry() = %v, want NotifyPostFailed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendEntry() didn't give up on a silent server")
+	}
+}
+
+// recordingSink keeps what it is handed, failing the first failing deliveries
+type recordingSink struct {
+	lock    sync.Mutex
+	entries []string
+	runs    int
+	failing int
+	block   chan struct{}
+}
+
+func (r *recordingSink) SendEntry(entry zapcore.Entry, fields map[string]interface{}) error {
+	if r.block != nil {
+		<-r.block
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.failing > 0 {
+		r.failing--
+		return NotifyPostFailed.New("unavailable")
+	}
+	r.entries = append(r.entries, entry.Message+" "+fieldText(fields["user"]))
+	return nil
+}
+
+func (r *recordingSink) SendRun(summary *RunSummary) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.runs++
+	return nil
+}
+
+func (r *recordingSink) Entries() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.entries...)
+}
+
+func newTestNotifierCore(sink NotifierSink) *NotifierCore {
+	core := NewNotifierCore("test", sink, zapcore.WarnLevel)
+	core.limiter = newTokenBucket(1000, 10)
+	core.RetryFor = 0
+	return core
+}
+
+func TestNotifierCore_Write(t *testing.T) {
+	sink := &recordingSink{}
+	core := newTestNotifierCore(sink)
+	log := zap.New(core).With(zap.String("user", "alice"))
+
+	log.Info("below the level")
+	log.Warn("rate limited")
+	log.Error("fetch failed")
+	if err := core.NotifyRun(testRunSummary()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"rate limited alice", "fetch failed alice"}
+	if got := sink.Entries(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+	if sink.runs != 1 {
+		t.Errorf("runs = %d, want 1", sink.runs)
+	}
+}
+
+func TestNotifierCore_RetriesFailedDeliveries(t *testing.T) {
+	sink := &recordingSink{failing: 2}
+	core := newTestNotifierCore(sink)
+	core.RetryFor = 5 * time.Second
+
+	core.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "fetch failed"}, nil)
+	core.Sync()
+
+	if got := sink.Entries(); len(got) != 1 {
+		t.Errorf("entries = %q, want the entry delivered once", got)
+	}
+	if core.queue.totalErrors != 0 {
+		t.Errorf("totalErrors = %d, want 0", core.queue.totalErrors)
+	}
+}
+
+func TestNotifierCore_Close(t *testing.T) {
+	sink := &recordingSink{}
+	core := newTestNotifierCore(sink)
+	clone := core.With([]zapcore.Field{zap.String("user", "bob")})
+
+	clone.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "fetch failed"}, nil)
+	if err := core.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := sink.Entries(); len(got) != 1 || got[0] != "fetch failed bob" {
+		t.Errorf("entries = %q, want the entry queued before close", got)
+	}
+	if err := clone.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "too late"}, nil); !errorx.IsOfType(err, NotifyClosed) {
+		t.Errorf("Write() after close = %v, want NotifyClosed", err)
+	}
+}
+
+func TestNotifierCore_CloseDropsAfterDeadline(t *testing.T) {
+	sink := &recordingSink{block: make(chan struct{})}
+	core := newTestNotifierCore(sink)
+	for i := 0; i < 3; i++ {
+		core.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "fetch failed"}, nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := core.Close(ctx); err == nil || !strings.Contains(err.Error(), "entries still queued") {
+		t.Errorf("Close() = %v, want the entries still queued reported", err)
+	}
+	close(sink.block)
+	<-core.queue.done
+}
+
+func TestNotifierCore_DropsWhenQueueFull(t *testing.T) {
+	core := newTestNotifierCore(&recordingSink{})
+	core.queue = newNotifyQueue[func() error](1)
+	// the worker never starts so nothing leaves the queue
+	core.queue.start.Do(func() {})
+
+	if err := core.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "queued"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- core.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "overflow"}, nil)
+	}()
+	select {
+	case err := <-done:
+		if !errorx.IsOfType(err, NotifyQueueFull) {
+			t.Errorf("writing to a full queue returned %v, want NotifyQueueFull", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing to a full queue blocked")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := core.Close(ctx); err == nil || !strings.Contains(err.Error(), "1 entries still queued") {
+		t.Errorf("Close() = %v, want the queued entry reported once ctx is done", err)
+	}
+}
+
+func TestNotifierCore_SyncWhileWriting(t *testing.T) {
+	sink := &recordingSink{}
+	core := newTestNotifierCore(sink)
+	core.queue = newNotifyQueue[func() error](1000)
+
+	// entries are queued while others wait for the queue to drain
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				core.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "entry"}, nil)
+				core.Sync()
+			}
+		}()
+	}
+	wg.Wait()
+	core.Sync()
+	if got := len(sink.Entries()); got != 500 {
+		t.Errorf("delivered %d entries, want 500", got)
+	}
+}
+
+func toJSONString(t *testing.T, v interface{}) string {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"go.uber.org/zap/zapcore"
+)
+
+// defaultWebhookTemplate posts every part of an event that is set
+const defaultWebhookTemplate = `{"kind":{{json .Kind}},"level":{{json .Level}},"message":{{json .Message}},"time":{{json .Time}}` +
+	`{{with .Logger}},"logger":{{json .}}{{end}}{{with .Caller}},"caller":{{json .}}{{end}}{{with .Stack}},"stack":{{json .}}{{end}}` +
+	`{{with .Fields}},"fields":{{json .}}{{end}}{{with .Summary}},"summary":{{json .}}{{end}}}`
+
+// webhookEvent is what a webhook template renders, a log entry or the summary of a run
+type webhookEvent struct {
+	// Kind is entry or run
+	Kind    string
+	Level   string
+	Message string
+	Time    time.Time
+	Logger  string
+	Caller  string
+	Stack   string
+	Fields  map[string]interface{}
+	Summary *RunSummary
+}
+
+// WebhookSink posts a JSON body rendered from a template to any URL
+type WebhookSink struct {
+	URL      string
+	template *template.Template
+	client   *http.Client
+}
+
+// NewWebhookSink parses body as a text/template of webhookEvent, the default template is used when it is empty
+func NewWebhookSink(url, body string, timeout time.Duration) (*WebhookSink, error) {
+	if body == "" {
+		body = defaultWebhookTemplate
+	}
+	tmpl, err := template.New("webhook").Funcs(template.FuncMap{"json": toJSON}).Parse(body)
+	if err != nil {
+		return nil, errorx.IllegalArgument.Wrap(err, "bad webhook template")
+	}
+	return &WebhookSink{URL: url, template: tmpl, client: &http.Client{Timeout: timeout}}, nil
+}
+
+func (w *WebhookSink) SendEntry(entry zapcore.Entry, fields map[string]interface{}) error {
+	event := webhookEvent{
+		Kind:    "entry",
+		Level:   entry.Level.String(),
+		Message: entry.Message,
+		Time:    entry.Time,
+		Logger:  entry.LoggerName,
+		Stack:   entry.Stack,
+		Fields:  fields,
+	}
+	if entry.Caller.Defined {
+		event.Caller = entry.Caller.TrimmedPath()
+	}
+	return w.post(event)
+}
+
+func (w *WebhookSink) SendRun(summary *RunSummary) error {
+	level := zapcore.InfoLevel
+	if summary.Result != runSucceeded {
+		level = zapcore.ErrorLevel
+	}
+	return w.post(webhookEvent{
+		Kind:    "run",
+		Level:   level.String(),
+		Message: summary.Title(),
+		Time:    summary.Finished,
+		Summary: summary,
+	})
+}
+
+// post renders event, a template that doesn't render JSON is rejected as retrying won't fix it
+func (w *WebhookSink) post(event webhookEvent) error {
+	var body bytes.Buffer
+	if err := w.template.Execute(&body, event); err != nil {
+		return NotifyRejected.Wrap(err, "failed to render webhook template")
+	}
+	if !json.Valid(body.Bytes()) {
+		return NotifyRejected.New("webhook template rendered invalid JSON: %s", truncate(body.String(), 200))
+	}
+	return postJSON(w.client, w.URL, body.Bytes())
+}
+
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/joomcode/errorx"
+)
+
+// snapshotStats picks the latest stats of each user collected for a snapshot date and range,
+// a day may hold several runs when one was resumed
+const snapshotStats = `WITH snapshot AS (
+	SELECT s.user_id, MAX(s.run_id) AS run_id
+	FROM user_stats s JOIN runs r ON r.id = s.run_id
+	WHERE r.snapshot_date = ? AND r.range_name = ?
+	GROUP BY s.user_id
+) `
+
+// Report aggregates the stats collected for one snapshot of a leader board range
+type Report struct {
+	Range        string
+	Date         string
+	PreviousDate string
+	Users        int
+
+	LanguagesByTime  []ReportShare
+	LanguagesByUsers []ReportShare
+	Editors          []ReportShare
+	OperatingSystems []ReportShare
+	DailyAverage     []ReportPercentile
+	// Shifts compares the share of users of the top languages with the previous snapshot
+	Shifts []ReportShift
+}
+
+// ReportShare is how much of the collected time and users one name of a breakdown accounts for
+type ReportShare struct {
+	Name         string
+	TotalSeconds float64
+	Users        int
+	TimeShare    float64
+	UserShare    float64
+}
+
+type ReportPercentile struct {
+	Percentile float64
+	Seconds    float64
+}
+
+type ReportShift struct {
+	Name              string
+	Rank              int
+	PreviousRank      int
+	UserShare         float64
+	PreviousUserShare float64
+}
+
+// Change is the shift in user share in percentage points
+func (s ReportShift) Change() float64 {
+	return (s.UserShare - s.PreviousUserShare) * 100
+}
+
+var reportPercentiles = []float64{50, 75, 90, 99}
+
+// BuildReport aggregates the snapshot of rangeName taken on date, the latest one when date is empty,
+// keeping the top names of each breakdown
+func (s *Store) BuildReport(rangeName, date string, top int) (*Report, error) {
+	if date == "" {
+		latest, err := s.snapshotBefore(rangeName, "9999-12-31")
+		if err != nil {
+			return nil, err
+		}
+		if latest == "" {
+			return nil, errorx.IllegalArgument.New("nothing collected for " + rangeName)
+		}
+		date = latest
+	}
+	previous, err := s.snapshotBefore(rangeName, date)
+	if err != nil {
+		return nil, err
+	}
+	r := &Report{Range: rangeName, Date: date, PreviousDate: previous}
+	if err := s.db.QueryRow(snapshotStats+`SELECT COUNT(*) FROM snapshot`, date, rangeName).Scan(&r.Users); err != nil {
+		return nil, err
+	}
+
+	languages, err := s.breakdownShares(rangeName, date, breakdownLanguage)
+	if err != nil {
+		return nil, err
+	}
+	r.LanguagesByTime = topShares(languages, top, func(a, b ReportShare) bool { return a.TotalSeconds > b.TotalSeconds })
+	r.LanguagesByUsers = topShares(languages, top, func(a, b ReportShare) bool { return a.Users > b.Users })
+	if r.Editors, err = s.breakdownShares(rangeName, date, breakdownEditor); err != nil {
+		return nil, err
+	}
+	r.Editors = topShares(r.Editors, top, func(a, b ReportShare) bool { return a.Users > b.Users })
+	if r.OperatingSystems, err = s.breakdownShares(rangeName, date, breakdownOperatingSystem); err != nil {
+		return nil, err
+	}
+	r.OperatingSystems = topShares(r.OperatingSystems, top, func(a, b ReportShare) bool { return a.Users > b.Users })
+
+	if r.DailyAverage, err = s.dailyAveragePercentiles(rangeName, date); err != nil {
+		return nil, err
+	}
+
+	if previous != "" {
+		before, err := s.breakdownShares(rangeName, previous, breakdownLanguage)
+		if err != nil {
+			return nil, err
+		}
+		r.Shifts = shifts(r.LanguagesByUsers, before)
+	}
+	return r, nil
+}
+
+// snapshotBefore returns the latest snapshot date of rangeName before date holding stats, or ""
+func (s *Store) snapshotBefore(rangeName, date string) (string, error) {
+	var snapshot sql.NullString
+	err := s.db.QueryRow(`SELECT MAX(r.snapshot_date) FROM runs r
+		WHERE r.range_name = ? AND r.snapshot_date < ? AND EXISTS (SELECT 1 FROM user_stats s WHERE s.run_id = r.id)`,
+		rangeName, date).Scan(&snapshot)
+	return snapshot.String, err
+}
+
+// breakdownShares returns every name of category with its share of the snapshot's time and users
+func (s *Store) breakdownShares(rangeName, date, category string) ([]ReportShare, error) {
+	rows, err := s.db.Query(snapshotStats+`SELECT b.name, COALESCE(SUM(b.total_seconds), 0), COUNT(DISTINCT b.user_id),
+			(SELECT COUNT(*) FROM snapshot)
+		FROM stat_breakdowns b JOIN snapshot USING (run_id, user_id)
+		WHERE b.category = ?
+		GROUP BY b.name`, date, rangeName, category)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var shares []ReportShare
+	var totalSeconds float64
+	for rows.Next() {
+		var share ReportShare
+		var users int
+		if err := rows.Scan(&share.Name, &share.TotalSeconds, &share.Users, &users); err != nil {
+			return nil, err
+		}
+		if users > 0 {
+			share.UserShare = float64(share.Users) / float64(users)
+		}
+		totalSeconds += share.TotalSeconds
+		shares = append(shares, share)
+	}
+	if totalSeconds > 0 {
+		for i := range shares {
+			shares[i].TimeShare = shares[i].TotalSeconds / totalSeconds
+		}
+	}
+	return shares, rows.Err()
+}
+
+func (s *Store) dailyAveragePercentiles(rangeName, date string) ([]ReportPercentile, error) {
+	rows, err := s.db.Query(snapshotStats+`SELECT COALESCE(s.daily_average, 0)
+		FROM user_stats s JOIN snapshot USING (run_id, user_id)
+		ORDER BY 1`, date, rangeName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var averages []float64
+	for rows.Next() {
+		var average float64
+		if err := rows.Scan(&average); err != nil {
+			return nil, err
+		}
+		averages = append(averages, average)
+	}
+	percentiles := make([]ReportPercentile, 0, len(reportPercentiles))
+	for _, p := range reportPercentiles {
+		percentiles = append(percentiles, ReportPercentile{Percentile: p, Seconds: percentile(averages, p)})
+	}
+	return percentiles, rows.Err()
+}
+
+// percentile interpolates the p-th percentile of sorted, 0 when it's empty
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	if lower+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lower] + (rank-float64(lower))*(sorted[lower+1]-sorted[lower])
+}
+
+// topShares returns the first top shares ordered by less, all of them when top isn't positive
+func topShares(shares []ReportShare, top int, less func(a, b ReportShare) bool) []ReportShare {
+	sorted := append([]ReportShare(nil), shares...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if less(sorted[i], sorted[j]) != less(sorted[j], sorted[i]) {
+			return less(sorted[i], sorted[j])
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	if top > 0 && len(sorted) > top {
+		sorted = sorted[:top]
+	}
+	return sorted
+}
+
+// shifts compares current, ordered by users, with the shares of the previous snapshot
+func shifts(current, previous []ReportShare) []ReportShift {
+	ranked := topShares(previous, 0, func(a, b ReportShare) bool { return a.Users > b.Users })
+	before := make(map[string]int, len(ranked))
+	for i, share := range ranked {
+		before[share.Name] = i
+	}
+	result := make([]ReportShift, 0, len(current))
+	for i, share := range current {
+		shift := ReportShift{Name: share.Name, Rank: i + 1, UserShare: share.UserShare}
+		if j, ok := before[share.Name]; ok {
+			shift.PreviousRank = j + 1
+			shift.PreviousUserShare = ranked[j].UserShare
+		}
+		result = append(result, shift)
+	}
+	return result
+}
+
+// reportSection is one table of a rendered report
+type reportSection struct {
+	Title  string
+	Header []string
+	Rows   [][]string
+}
+
+func (r *Report) sections() []reportSection {
+	shareSection := func(title string, shares []ReportShare) reportSection {
+		section := reportSection{Title: title, Header: []string{"#", "Name", "Hours", "Time share", "Users", "User share"}}
+		for i, share := range shares {
+			section.Rows = append(section.Rows, []string{fmt.Sprint(i + 1), share.Name, formatHours(share.TotalSeconds),
+				formatPercent(share.TimeShare), fmt.Sprint(share.Users), formatPercent(share.UserShare)})
+		}
+		return section
+	}
+	sections := []reportSection{
+		shareSection("Top languages by time", r.LanguagesByTime),
+		shareSection("Top languages by users", r.LanguagesByUsers),
+		shareSection("Editors", r.Editors),
+		shareSection("Operating systems", r.OperatingSystems),
+	}
+	averages := reportSection{Title: "Daily average", Header: []string{"Percentile", "Hours"}}
+	for _, p := range r.DailyAverage {
+		averages.Rows = append(averages.Rows, []string{fmt.Sprintf("p%g", p.Percentile), formatHours(p.Seconds)})
+	}
+	sections = append(sections, averages)
+	if r.PreviousDate != "" {
+		changes := reportSection{Title: "Language shifts since " + r.PreviousDate,
+			Header: []string{"#", "Name", "Previous #", "User share", "Previous share", "Change"}}
+		for _, shift := range r.Shifts {
+			previousRank := "new"
+			if shift.PreviousRank > 0 {
+				previousRank = fmt.Sprint(shift.PreviousRank)
+			}
+			changes.Rows = append(changes.Rows, []string{fmt.Sprint(shift.Rank), shift.Name, previousRank,
+				formatPercent(shift.UserShare), formatPercent(shift.PreviousUserShare), fmt.Sprintf("%+.1fpp", shift.Change())})
+		}
+		sections = append(sections, changes)
+	}
+	return sections
+}
+
+func (r *Report) title() string {
+	return fmt.Sprintf("%s leader board on %s, %d users", r.Range, r.Date, r.Users)
+}
+
+func formatHours(seconds float64) string {
+	return fmt.Sprintf("%.1f", seconds/3600)
+}
+
+func formatPercent(share float64) string {
+	return fmt.Sprintf("%.1f%%", share*100)
+}
+
+// RenderReport writes r as a terminal table, markdown or html
+func RenderReport(w io.Writer, r *Report, format string) error {
+	switch format {
+	case "table":
+		return renderReportTable(w, r)
+	case "markdown":
+		return renderReportMarkdown(w, r)
+	case "html":
+		return reportTemplate.Execute(w, struct {
+			Title    string
+			Sections []reportSection
+		}{r.title(), r.sections()})
+	}
+	return errorx.IllegalArgument.New(fmt.Sprintf("unknown report format %q", format))
+}
+
+func renderReportTable(w io.Writer, r *Report) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, r.title())
+	for _, section := range r.sections() {
+		fmt.Fprintf(tw, "\n%s\n", section.Title)
+		fmt.Fprintln(tw, strings.Join(section.Header, "\t"))
+		for _, row := range section.Rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+	}
+	return tw.Flush()
+}
+
+func renderReportMarkdown(w io.Writer, r *Report) error {
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "# %s\n", r.title())
+	for _, section := range r.sections() {
+		fmt.Fprintf(b, "\n## %s\n\n", section.Title)
+		fmt.Fprintf(b, "| %s |\n", strings.Join(section.Header, " | "))
+		fmt.Fprintf(b, "|%s\n", strings.Repeat(" --- |", len(section.Header)))
+		for _, row := range section.Rows {
+			escaped := make([]string, len(row))
+			for i, cell := range row {
+				escaped[i] = strings.ReplaceAll(cell, "|", `\|`)
+			}
+			fmt.Fprintf(b, "| %s |\n", strings.Join(escaped, " | "))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{range .Sections}}<h2>{{.Title}}</h2>
+<table>
+<tr>{{range .Header}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+// report is the handler of the report command
+func report() (rerr error) {
+	if *databaseFile == "" {
+		return errorx.IllegalArgument.New("report reads the --database, it can't be empty")
+	}
+	s, err := OpenStore(*databaseFile)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	days, _ := strconv.Atoi(*reportRange)
+	r, err := s.BuildReport(rangeLeaderBoardString(days), *reportDate, *reportTop)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *reportOutput != "" && *reportOutput != "-" {
+		f, err := os.Create(*reportOutput)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := f.Close(); err != nil && rerr == nil {
+				rerr = err
+			}
+		}()
+		w = f
+	}
+	return RenderReport(w, r, *reportFormat)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/will7200/go-wakatime/models"
+)
+
+func Test_percentile(t *testing.T) {
+	sorted := []float64{10, 20, 30, 40}
+	tests := []struct {
+		p    float64
+		want float64
+	}{
+		{p: 0, want: 10},
+		{p: 50, want: 25},
+		{p: 100, want: 40},
+	}
+	for _, tt := range tests {
+		if got := percentile(sorted, tt.p); got != tt.want {
+			t.Errorf("percentile(%v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("percentile of nothing = %v", got)
+	}
+}
+
+func TestStore_BuildReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := OpenStore(filepath.Join(dir, "wakatime.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// a single Go user the day before, then two users of which only one writes Go
+	recordTestRun(t, s, time.Date(2019, 1, 1, 12, 0, 0, 0, time.Local))
+	runID := recordTestRun(t, s, time.Date(2019, 1, 2, 12, 0, 0, 0, time.Local))
+	rust := &models.Stats{
+		DailyAverage:     7200,
+		Languages:        []*models.StatsCategory{{Name: "Rust", TotalSeconds: 7200}},
+		Editors:          []*models.StatsCategory{{Name: "Emacs", TotalSeconds: 7200}},
+		OperatingSystems: []*models.StatsCategory{{Name: "Linux", TotalSeconds: 7200}},
+	}
+	if err := s.SaveUserStats(runID, "b", rust, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s.BuildReport("last_7_days", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Date != "2019-01-02" || r.PreviousDate != "2019-01-01" || r.Users != 2 {
+		t.Errorf("report of %s after %s with %d users", r.Date, r.PreviousDate, r.Users)
+	}
+	if r.LanguagesByTime[0].Name != "Rust" || r.LanguagesByUsers[0].Name != "Go" {
+		t.Errorf("top languages by time %v, by users %v", r.LanguagesByTime, r.LanguagesByUsers)
+	}
+	if system := r.OperatingSystems[0]; system.Name != "Linux" || system.UserShare != 1 {
+		t.Errorf("operating systems = %+v", r.OperatingSystems)
+	}
+	if r.DailyAverage[0].Percentile != 50 || r.DailyAverage[0].Seconds != 3600 {
+		t.Errorf("median daily average = %+v", r.DailyAverage[0])
+	}
+	shifts := map[string]ReportShift{}
+	for _, shift := range r.Shifts {
+		shifts[shift.Name] = shift
+	}
+	if change := shifts["Go"].Change(); change != -50 {
+		t.Errorf("Go shifted %vpp, want -50pp", change)
+	}
+	if shifts["Rust"].PreviousRank != 0 {
+		t.Errorf("Rust should be new, was ranked %d", shifts["Rust"].PreviousRank)
+	}
+
+	for format, want := range map[string]string{
+		"table":    "Language shifts since 2019-01-01",
+		"markdown": "| 1 | Go | 1 | 50.0% | 100.0% | -50.0pp |",
+		"html":     "<td>Rust</td>",
+	} {
+		b := new(bytes.Buffer)
+		if err := RenderReport(b, r, format); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("%s report is missing %q:\n%s", format, want, b)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"go.uber.org/zap"
+)
+
+// runPanicked is the result of a run that was ended by a recovered panic, the store records it as a failure
+const runPanicked = "panic"
+
+// RunSummary is what a run did, handed to every notifier once it is over
+type RunSummary struct {
+	RunID    int64     `json:"run_id"`
+	Range    string    `json:"range"`
+	Host     string    `json:"host,omitempty"`
+	Version  string    `json:"version,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"`
+	// Discovered and Collected count every user of the snapshot, including those
+	// collected by an earlier run of the same day
+	Discovered int `json:"users_discovered"`
+	Collected  int `json:"users_collected"`
+	// CollectedThisRun is how many users this run collected stats of
+	CollectedThisRun int `json:"users_collected_this_run"`
+	// Errors counts failed stats requests by kind: timeout, not_found or error
+	Errors map[string]int `json:"errors,omitempty"`
+	// Accepted counts users skipped because wakatime was still computing their stats
+	Accepted int `json:"users_accepted"`
+	// Previous is the last finished run of the same range, nil for the first one
+	Previous *RunSummary `json:"previous,omitempty"`
+}
+
+// RunNotifier delivers run summaries
+type RunNotifier interface {
+	NotifyRun(summary *RunSummary) error
+}
+
+func newRunSummary(runID int64, rangeName string, started time.Time) *RunSummary {
+	host, _ := os.Hostname()
+	return &RunSummary{
+		RunID:   runID,
+		Range:   rangeName,
+		Host:    host,
+		Version: GitSummary,
+		Started: started,
+		Errors:  map[string]int{},
+	}
+}
+
+// finish records how the run ended, a panic result is kept when rerr came from one
+func (s *RunSummary) finish(rerr error, discovered, collected int, finished time.Time) {
+	s.Finished, s.Discovered, s.Collected = finished, discovered, collected
+	switch {
+	case s.Result == runPanicked:
+	case rerr != nil:
+		s.Result = runFailed
+	default:
+		s.Result = runSucceeded
+	}
+	if rerr != nil {
+		s.Error = rerr.Error()
+	}
+}
+
+func (s *RunSummary) Duration() time.Duration {
+	return s.Finished.Sub(s.Started)
+}
+
+func (s *RunSummary) Remaining() int {
+	return s.Discovered - s.Collected
+}
+
+// Throughput is how many users this run collected per minute
+func (s *RunSummary) Throughput() float64 {
+	minutes := s.Duration().Minutes()
+	if minutes <= 0 {
+		return 0
+	}
+	return float64(s.CollectedThisRun) / minutes
+}
+
+func (s *RunSummary) TotalErrors() int {
+	total := 0
+	for _, n := range s.Errors {
+		total += n
+	}
+	return total
+}
+
+// Title is a one line account of the run
+func (s *RunSummary) Title() string {
+	state := map[string]string{runSucceeded: "Run finished", runFailed: "Run failed", runPanicked: "Run crashed"}[s.Result]
+	title := fmt.Sprintf("%s: %s", state, s.Range)
+	if s.Host != "" {
+		title += " on " + s.Host
+	}
+	return title
+}
+
+// ErrorBreakdown lists the error counts by kind, eg "3 timeout, 1 not_found"
+func (s *RunSummary) ErrorBreakdown() string {
+	if len(s.Errors) == 0 {
+		return "none"
+	}
+	kinds := make([]string, 0, len(s.Errors))
+	for kind := range s.Errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	parts := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		parts = append(parts, fmt.Sprintf("%d %s", s.Errors[kind], kind))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Comparison tells how the run differs from the previous one, empty without one
+func (s *RunSummary) Comparison() string {
+	p := s.Previous
+	if p == nil {
+		return ""
+	}
+	return fmt.Sprintf("compared to run %d on %s: duration %s, throughput %+.1f/min, collected %+d, errors %+d",
+		p.RunID, p.Started.Format(snapshotDateFormat), signedDuration(s.Duration()-p.Duration()),
+		s.Throughput()-p.Throughput(), s.CollectedThisRun-p.CollectedThisRun, s.TotalErrors()-p.TotalErrors())
+}
+
+// Report formats the summary as plain text
+func (s *RunSummary) Report() string {
+	var b strings.Builder
+	fmt.Fprintln(&b, s.Title())
+	if s.Error != "" {
+		fmt.Fprintf(&b, "error: %s\n", s.Error)
+	}
+	fmt.Fprintf(&b, "duration %s, %d users collected this run (%.1f/min)\n", shortDuration(s.Duration()), s.CollectedThisRun, s.Throughput())
+	fmt.Fprintf(&b, "%d of %d users collected, %d remaining\n", s.Collected, s.Discovered, s.Remaining())
+	fmt.Fprintf(&b, "errors: %s\n", s.ErrorBreakdown())
+	if s.Accepted > 0 {
+		fmt.Fprintf(&b, "%d users skipped while wakatime computes their stats\n", s.Accepted)
+	}
+	if comparison := s.Comparison(); comparison != "" {
+		fmt.Fprintln(&b, comparison)
+	}
+	return b.String()
+}
+
+// signedDuration formats d with a sign, eg +2m30s or -45s
+func signedDuration(d time.Duration) string {
+	if d < 0 {
+		return "-" + shortDuration(-d)
+	}
+	return "+" + shortDuration(d)
+}
+
+// panicError turns what recover returned into an error carrying the stack of the panic
+func panicError(recovered interface{}) error {
+	if err, ok := errorx.ErrorFromPanic(recovered); ok {
+		return errorx.Decorate(err, "panic")
+	}
+	return errorx.InternalError.New("panic: %v", recovered)
+}
+
+// notifyRun hands summary to every configured notifier, failures are only logged
+func notifyRun(summary *RunSummary) {
+	for _, notifier := range notifiers {
+		if err := notifier.NotifyRun(summary); err != nil {
+			logger.Warn("Failed to deliver run summary", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+func TestRunSummary_Report(t *testing.T) {
+	started := time.Date(2019, 1, 2, 12, 0, 0, 0, time.UTC)
+	summary := &RunSummary{
+		RunID: 2, Range: "last_7_days", Host: "node-1", Started: started, Finished: started.Add(10 * time.Minute),
+		Result: runSucceeded, Discovered: 500, Collected: 480, CollectedThisRun: 300,
+		Errors: map[string]int{"timeout": 3, "not_found": 1}, Accepted: 2,
+		Previous: &RunSummary{
+			RunID: 1, Started: started.AddDate(0, 0, -1), Finished: started.AddDate(0, 0, -1).Add(12 * time.Minute),
+			CollectedThisRun: 240, Errors: map[string]int{"timeout": 6},
+		},
+	}
+	want := []string{
+		"Run finished: last_7_days on node-1",
+		"duration 10m, 300 users collected this run (30.0/min)",
+		"480 of 500 users collected, 20 remaining",
+		"errors: 1 not_found, 3 timeout",
+		"2 users skipped while wakatime computes their stats",
+		"compared to run 1 on 2019-01-01: duration -2m, throughput +10.0/min, collected +60, errors -2",
+	}
+	if got := strings.Split(strings.TrimSpace(summary.Report()), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Report() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRunSummary_Finish(t *testing.T) {
+	summary := newRunSummary(1, "last_7_days", time.Now())
+	summary.finish(nil, 2, 1, time.Now())
+	if summary.Result != runSucceeded || summary.Error != "" {
+		t.Errorf("a run without error finished as %q %q", summary.Result, summary.Error)
+	}
+
+	func() {
+		defer func() {
+			summary.Result = runPanicked
+			summary.finish(panicError(recover()), 2, 1, time.Now())
+		}()
+		panic("boom")
+	}()
+	if summary.Result != runPanicked || summary.Error != "common.internal_error: panic: boom" {
+		t.Errorf("a panicking run finished as %q %q", summary.Result, summary.Error)
+	}
+	if err := panicError(errorx.IllegalArgument.New("bad")); !errorx.IsOfType(err, errorx.IllegalArgument) {
+		t.Errorf("panicking with an error lost its type: %v", err)
+	}
+}
+
+func TestStore_PreviousRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := OpenStore(filepath.Join(dir, "wakatime.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	first := recordTestRun(t, s, time.Date(2019, 1, 1, 12, 0, 0, 0, time.Local))
+	if _, err := s.ImportRun("last_7_days", time.Date(2019, 1, 2, 0, 0, 0, 0, time.Local)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.StartRun("last_7_days", time.Date(2019, 1, 3, 12, 0, 0, 0, time.Local)); err != nil {
+		t.Fatal(err)
+	}
+	current, err := s.StartRun("last_7_days", time.Date(2019, 1, 4, 12, 0, 0, 0, time.Local))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// imported and unfinished runs are skipped
+	previous, err := s.PreviousRun("last_7_days", current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previous == nil || previous.RunID != first || previous.Result != runSucceeded {
+		t.Fatalf("PreviousRun() = %+v, want run %d", previous, first)
+	}
+	if previous.Discovered != 2 || previous.Collected != 1 || previous.CollectedThisRun != 1 || previous.Errors["timeout"] != 1 {
+		t.Errorf("previous run counts %+v", previous)
+	}
+	if previous.Finished.Before(previous.Started) {
+		t.Errorf("previous run finished %v before it started %v", previous.Finished, previous.Started)
+	}
+
+	if previous, err := s.PreviousRun("last_7_days", first); err != nil || previous != nil {
+		t.Errorf("the first run has previous run %+v, %v", previous, err)
+	}
+	if previous, err := s.PreviousRun("last_30_days", current); err != nil || previous != nil {
+		t.Errorf("a range without runs has previous run %+v, %v", previous, err)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+)
+
+// ScheduledJob collects one leader board range on a cron schedule
+type ScheduledJob struct {
+	Range    int
+	Spec     string
+	schedule cron.Schedule
+	// pending is set while the job is queued or running
+	pending bool
+}
+
+// ScheduleState is the persisted record of a job's runs
+type ScheduleState struct {
+	LastStart  time.Time `json:"last_start"`
+	LastFinish time.Time `json:"last_finish"`
+	LastError  string    `json:"last_error,omitempty"`
+	NextRun    time.Time `json:"next_run"`
+}
+
+// Scheduler runs collections for several ranges on their own schedules. Runs are
+// executed one at a time since a collection owns the working directory, and a job
+// that is still queued or running when it comes due again is skipped.
+type Scheduler struct {
+	Jobs []*ScheduledJob
+	// Jitter is the maximum random delay added to every scheduled run
+	Jitter time.Duration
+	// StateFile records the last and next run of every job, empty disables it
+	StateFile string
+	// RunAtStart makes jobs without a recorded next run due as soon as the scheduler starts
+	RunAtStart bool
+	// Run performs a collection of leaderRange dispatched at the given time
+	Run func(leaderRange int, scheduled time.Time) error
+
+	lock  sync.Mutex
+	state map[string]*ScheduleState
+	queue chan scheduledRun
+	now   func() time.Time
+}
+
+type scheduledRun struct {
+	job       *ScheduledJob
+	scheduled time.Time
+}
+
+// NewScheduler creates a scheduler from cron specs keyed by leader board range, eg 7="0 */6 * * *"
+func NewScheduler(specs map[string]string, jitter time.Duration, stateFile string, run func(int, time.Time) error) (*Scheduler, error) {
+	s := &Scheduler{
+		Jitter:    jitter,
+		StateFile: stateFile,
+		Run:       run,
+		state:     make(map[string]*ScheduleState),
+		now:       time.Now,
+	}
+	for key, spec := range specs {
+		leaderRange, err := strconv.Atoi(key)
+		if err != nil || !validRange(leaderRange) {
+			return nil, errorx.IllegalArgument.New(fmt.Sprintf("unknown range %q, pick from 7, 30, 180, 365", key))
+		}
+		schedule, err := cron.ParseStandard(spec)
+		if err != nil {
+			return nil, errorx.IllegalArgument.Wrap(err, fmt.Sprintf("schedule for range %s", key))
+		}
+		s.Jobs = append(s.Jobs, &ScheduledJob{Range: leaderRange, Spec: spec, schedule: schedule})
+	}
+	if len(s.Jobs) == 0 {
+		return nil, errorx.IllegalArgument.New("no ranges scheduled")
+	}
+	sort.Slice(s.Jobs, func(i, j int) bool { return s.Jobs[i].Range < s.Jobs[j].Range })
+	s.queue = make(chan scheduledRun, len(s.Jobs))
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func validRange(leaderRange int) bool {
+	switch leaderRange {
+	case 7, 30, 180, 365:
+		return true
+	}
+	return false
+}
+
+func (j *ScheduledJob) key() string {
+	return strconv.Itoa(j.Range)
+}
+
+// Start runs the scheduler until ctx is cancelled
+func (s *Scheduler) Start(ctx context.Context) {
+	go s.worker(ctx)
+
+	s.lock.Lock()
+	now := s.now()
+	for _, job := range s.Jobs {
+		state := s.jobState(job)
+		if state.NextRun.IsZero() {
+			state.NextRun = s.next(job, now)
+			if s.RunAtStart {
+				state.NextRun = now
+			}
+		}
+		logger.Info("Scheduled collection", zap.Int("range", job.Range), zap.String("schedule", job.Spec), zap.Time("next", state.NextRun))
+	}
+	s.persist()
+	s.lock.Unlock()
+
+	for {
+		wait := time.Until(s.nextDue())
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			s.dispatch()
+		}
+	}
+}
+
+// nextDue returns the earliest next run of all jobs
+func (s *Scheduler) nextDue() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var earliest time.Time
+	for _, job := range s.Jobs {
+		next := s.jobState(job).NextRun
+		if earliest.IsZero() || next.Before(earliest) {
+			earliest = next
+		}
+	}
+	return earliest
+}
+
+// dispatch queues every job that is due and schedules its next run.
+// Jobs missed while the process was down are due immediately.
+func (s *Scheduler) dispatch() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := s.now()
+	for _, job := range s.Jobs {
+		state := s.jobState(job)
+		if state.NextRun.After(now) {
+			continue
+		}
+		state.NextRun = s.next(job, now)
+		if job.pending {
+			logger.Warn("Skipping scheduled collection, previous run has not finished",
+				zap.Int("range", job.Range), zap.Time("next", state.NextRun))
+			continue
+		}
+		job.pending = true
+		s.queue <- scheduledRun{job: job, scheduled: now}
+	}
+	s.persist()
+}
+
+func (s *Scheduler) worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-s.queue:
+			s.lock.Lock()
+			state := s.jobState(r.job)
+			state.LastStart = s.now()
+			s.persist()
+			s.lock.Unlock()
+
+			err := s.Run(r.job.Range, r.scheduled)
+
+			s.lock.Lock()
+			state.LastFinish = s.now()
+			state.LastError = ""
+			if err != nil {
+				state.LastError = err.Error()
+				logger.Error("Scheduled collection failed", zap.Int("range", r.job.Range), zap.Error(err))
+			}
+			r.job.pending = false
+			s.persist()
+			s.lock.Unlock()
+		}
+	}
+}
+
+// next returns the job's next run after now including jitter
+func (s *Scheduler) next(job *ScheduledJob, now time.Time) time.Time {
+	next := job.schedule.Next(now)
+	if s.Jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(s.Jitter))))
+	}
+	return next
+}
+
+func (s *Scheduler) jobState(job *ScheduledJob) *ScheduleState {
+	state, ok := s.state[job.key()]
+	if !ok {
+		state = &ScheduleState{}
+		s.state[job.key()] = state
+	}
+	return state
+}
+
+// State returns a copy of the persisted state of every job keyed by range
+func (s *Scheduler) State() map[string]ScheduleState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	states := make(map[string]ScheduleState, len(s.state))
+	for key, state := range s.state {
+		states[key] = *state
+	}
+	return states
+}
+
+func (s *Scheduler) load() error {
+	if s.StateFile == "" {
+		return nil
+	}
+	f, err := os.Open(s.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(&s.state)
+}
+
+// persist writes the state file, the caller must hold s.lock
+func (s *Scheduler) persist() {
+	if s.StateFile == "" {
+		return
+	}
+	err := writeAtomically(s.StateFile, func(w io.Writer) error {
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		return e.Encode(s.state)
+	})
+	if err != nil {
+		logger.Error("Failed to persist schedule state", zap.String("file", s.StateFile), zap.Error(err))
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewScheduler_InvalidSpecs(t *testing.T) {
+	tests := []struct {
+		name  string
+		specs map[string]string
+	}{
+		{name: "UnknownRange", specs: map[string]string{"14": "@daily"}},
+		{name: "BadSpec", specs: map[string]string{"7": "every day"}},
+		{name: "Empty", specs: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewScheduler(tt.specs, 0, "", nil); err == nil {
+				t.Error("NewScheduler() expected error")
+			}
+		})
+	}
+}
+
+func TestScheduler_DispatchSkipsOverlap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scheduler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "schedule.state")
+
+	release := make(chan struct{})
+	started := make(chan int, 10)
+	s, err := NewScheduler(map[string]string{"7": "@hourly", "365": "@weekly"}, time.Minute, stateFile,
+		func(leaderRange int, scheduled time.Time) error {
+			started <- leaderRange
+			<-release
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2019, 1, 1, 0, 30, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	for _, job := range s.Jobs {
+		s.jobState(job).NextRun = now
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.worker(ctx)
+
+	s.dispatch()
+	if got := <-started; got != 7 {
+		t.Fatalf("first run = %d, want 7", got)
+	}
+
+	next := s.State()["7"].NextRun
+	if next.Before(now.Add(30*time.Minute)) || !next.Before(now.Add(31*time.Minute)) {
+		t.Errorf("next run = %v, want within jitter of 01:00", next)
+	}
+
+	// range 7 is running and 365 queued, neither is queued again when due
+	now = now.Add(8 * 24 * time.Hour)
+	s.dispatch()
+	if len(s.queue) != 1 {
+		t.Errorf("queue length = %d, want 1", len(s.queue))
+	}
+
+	close(release)
+	if got := <-started; got != 365 {
+		t.Fatalf("second run = %d, want 365", got)
+	}
+
+	reloaded, err := NewScheduler(map[string]string{"7": "@hourly"}, 0, stateFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := reloaded.State()["7"]; state.LastStart.IsZero() || !state.NextRun.After(now) {
+		t.Errorf("persisted state = %+v", state)
+	}
+}
+
+func TestScheduler_RunAtStart(t *testing.T) {
+	started := make(chan int, 1)
+	s, err := NewScheduler(map[string]string{"30": "@every 6h"}, time.Hour, "", func(leaderRange int, scheduled time.Time) error {
+		started <- leaderRange
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RunAtStart = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Start(ctx)
+
+	select {
+	case got := <-started:
+		if got != 30 {
+			t.Errorf("first run = %d, want 30", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("first run didn't start right away")
+	}
+	if next := s.State()["30"].NextRun; next.Before(time.Now().Add(5 * time.Hour)) {
+		t.Errorf("next run = %v, want the interval after the first run", next)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// schemaHeaderPrefix starts the line after the codec header holding the JSON encoded Envelope
+const schemaHeaderPrefix = "#schema "
+
+const (
+	// usersArrayKind is allusers.array, every user id seen on a leader board
+	usersArrayKind = "users-array"
+	// usersStateKind is users.tmp, whether each user's stats were collected
+	usersStateKind = "users-state"
+)
+
+var (
+	UnknownSchema = storageNamespace.NewType("unknown_schema")
+	NewerSchema   = storageNamespace.NewType("newer_schema")
+	WrongKind     = storageNamespace.NewType("wrong_kind")
+)
+
+// Envelope describes a persisted state file. Files written before envelopes
+// existed are schema version 0.
+type Envelope struct {
+	Kind          string    `json:"kind"`
+	SchemaVersion int       `json:"schema_version"`
+	CreatedBy     string    `json:"created_by"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// migration upgrades the payload of a state file by one schema version
+type migration struct {
+	Description string
+	Migrate     func(payload []byte, c *Codec) ([]byte, error)
+}
+
+// stateMigrations is the migration chain of every kind of state file, migrations[from]
+// upgrades version from to from+1 so the current version is the length of the chain
+var stateMigrations = map[string][]migration{
+	usersArrayKind: {
+		{Description: "bare []string wrapped in an envelope", Migrate: unchangedPayload},
+	},
+	usersStateKind: {
+		{Description: "bare map[string]bool wrapped in an envelope", Migrate: unchangedPayload},
+	},
+}
+
+// unchangedPayload migrates files whose envelope changed but not their payload
+func unchangedPayload(payload []byte, _ *Codec) ([]byte, error) {
+	return payload, nil
+}
+
+// migrateState runs the migrations of kind bringing payload from version to the current version
+func migrateState(kind string, version int, payload []byte, c *Codec) ([]byte, error) {
+	migrations := stateMigrations[kind]
+	for ; version < len(migrations); version++ {
+		m := migrations[version]
+		var err error
+		payload, err = m.Migrate(payload, c)
+		if err != nil {
+			return nil, UnknownSchema.Wrap(err, fmt.Sprintf("migrating %s from version %d", kind, version))
+		}
+		logger.Debug("Migrated state", zap.String("kind", kind), zap.Int("from", version), zap.String("migration", m.Description))
+	}
+	return payload, nil
+}
+
+// SaveState writes v as the current schema version of kind encoded with c
+func SaveState(w io.Writer, kind string, v interface{}, c *Codec) error {
+	migrations, ok := stateMigrations[kind]
+	if !ok {
+		return UnknownSchema.New(kind)
+	}
+	envelope, err := json.Marshal(Envelope{
+		Kind:          kind,
+		SchemaVersion: len(migrations),
+		CreatedBy:     GitSummary,
+		CreatedAt:     time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	r, err := c.Encode(v)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, codecHeaderPrefix+c.Name+"\n"+schemaHeaderPrefix+string(envelope)+"\n"); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// LoadState reads the state file at path into v, upgrading older schema versions.
+// An empty kind accepts any kind recorded in the file, files without an envelope
+// then can't be loaded.
+func LoadState(path string, kind string, v interface{}) (*Envelope, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, body, err := splitCodecHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		// written before codecs were recorded
+		c = GobCodec
+	}
+	envelope, payload, err := splitSchemaHeader(body)
+	if err != nil {
+		return nil, err
+	}
+	if envelope == nil {
+		envelope = &Envelope{Kind: kind}
+	}
+	if kind != "" && envelope.Kind != kind {
+		return nil, WrongKind.New(fmt.Sprintf("%s holds %q, expected %q", path, envelope.Kind, kind))
+	}
+	migrations, ok := stateMigrations[envelope.Kind]
+	if !ok {
+		return nil, UnknownSchema.New(fmt.Sprintf("%s holds unknown kind %q", path, envelope.Kind))
+	}
+	if envelope.SchemaVersion > len(migrations) {
+		return nil, NewerSchema.New(fmt.Sprintf("%s is %s version %d written by %q, this build reads up to version %d",
+			path, envelope.Kind, envelope.SchemaVersion, envelope.CreatedBy, len(migrations)))
+	}
+	payload, err = migrateState(envelope.Kind, envelope.SchemaVersion, payload, c)
+	if err != nil {
+		return nil, err
+	}
+	return envelope, c.Decode(bytes.NewReader(payload), v)
+}
+
+// splitCodecHeader returns the codec named in the header of b and the rest of b,
+// the codec is nil when b has no header
+func splitCodecHeader(b []byte) (*Codec, []byte, error) {
+	line, rest, ok := cutHeaderLine(b, codecHeaderPrefix)
+	if !ok {
+		return nil, b, nil
+	}
+	c, err := LookupCodec(line)
+	return c, rest, err
+}
+
+// splitSchemaHeader returns the envelope at the start of b and the payload after it,
+// the envelope is nil when b has none
+func splitSchemaHeader(b []byte) (*Envelope, []byte, error) {
+	line, rest, ok := cutHeaderLine(b, schemaHeaderPrefix)
+	if !ok {
+		return nil, b, nil
+	}
+	envelope := &Envelope{}
+	if err := json.Unmarshal([]byte(line), envelope); err != nil {
+		return nil, nil, UnknownSchema.Wrap(err, "unreadable envelope")
+	}
+	return envelope, rest, nil
+}
+
+func cutHeaderLine(b []byte, prefix string) (string, []byte, bool) {
+	if !bytes.HasPrefix(b, []byte(prefix)) {
+		return "", b, false
+	}
+	end := bytes.IndexByte(b, '\n')
+	if end < 0 {
+		return "", b, false
+	}
+	return strings.TrimSpace(string(b[len(prefix):end])), b[end+1:], true
+}
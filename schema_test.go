@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/joomcode/errorx"
+)
+
+// migrationFixtures holds, for every kind and schema version, a file as it was
+// written at that version and the value it must load as
+var migrationFixtures = map[string]map[int]struct {
+	write func(w io.Writer) error
+	want  interface{}
+}{
+	usersArrayKind: {
+		0: {
+			write: func(w io.Writer) error { return writeReader(w, GlobEncoder, []string{"a", "b"}) },
+			want:  []string{"a", "b"},
+		},
+	},
+	usersStateKind: {
+		0: {
+			write: func(w io.Writer) error { return writeReader(w, GlobEncoder, map[string]bool{"a": true, "b": false}) },
+			want:  map[string]bool{"a": true, "b": false},
+		},
+	},
+}
+
+func writeReader(w io.Writer, encode marshaller, v interface{}) error {
+	r, err := encode(v)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLoadState_Migrations(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	for kind, migrations := range stateMigrations {
+		for from := range migrations {
+			t.Run(fmt.Sprintf("%s/%d", kind, from), func(t *testing.T) {
+				fixture, ok := migrationFixtures[kind][from]
+				if !ok {
+					t.Fatalf("no fixture for the migration from version %d", from)
+				}
+				file := filepath.Join(dir, kind)
+				if err := writeAtomically(file, fixture.write); err != nil {
+					t.Fatal(err)
+				}
+				got := reflect.New(reflect.TypeOf(fixture.want))
+				envelope, err := LoadState(file, kind, got.Interface())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if envelope.SchemaVersion != from {
+					t.Errorf("envelope version = %d, want %d", envelope.SchemaVersion, from)
+				}
+				if !reflect.DeepEqual(got.Elem().Interface(), fixture.want) {
+					t.Errorf("loaded %v, want %v", got.Elem().Interface(), fixture.want)
+				}
+			})
+		}
+	}
+}
+
+func TestSaveState_RoundTrip(t *testing.T) {
+	b := new(bytes.Buffer)
+	if err := SaveState(b, usersStateKind, map[string]bool{"a": true}, JSONCodec); err != nil {
+		t.Fatal(err)
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "users.tmp")
+	if err := ioutil.WriteFile(file, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]bool{}
+	envelope, err := LoadState(file, "", &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Kind != usersStateKind || envelope.SchemaVersion != len(stateMigrations[usersStateKind]) || envelope.CreatedBy != GitSummary {
+		t.Errorf("envelope = %+v", envelope)
+	}
+	if !got["a"] {
+		t.Errorf("LoadState() = %v", got)
+	}
+
+	var ids []string
+	if _, err := LoadState(file, usersArrayKind, &ids); !errorx.IsOfType(err, WrongKind) {
+		t.Errorf("LoadState() with the wrong kind = %v, want WrongKind", err)
+	}
+}
+
+func TestLoadState_RejectsNewerSchema(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "allusers.array")
+	contents := codecHeaderPrefix + "json\n" + schemaHeaderPrefix + `{"kind":"users-array","schema_version":99,"created_by":"future"}` + "\n[]\n"
+	if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	if _, err := LoadState(file, usersArrayKind, &ids); !errorx.IsOfType(err, NewerSchema) {
+		t.Errorf("LoadState() = %v, want NewerSchema", err)
+	}
+}
+
+func TestMigrateState_RunsInOrder(t *testing.T) {
+	appending := func(suffix string) migration {
+		return migration{Description: "append " + suffix, Migrate: func(payload []byte, _ *Codec) ([]byte, error) {
+			return append(payload, suffix...), nil
+		}}
+	}
+	stateMigrations["test"] = []migration{appending("1"), appending("2")}
+	defer delete(stateMigrations, "test")
+
+	for from, want := range []string{"x12", "x2", "x"} {
+		got, err := migrateState("test", from, []byte("x"), JSONCodec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("migrateState() from version %d = %q, want %q", from, got, want)
+		}
+	}
+}
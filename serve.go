@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// serve runs collections on a schedule and exposes the metrics registry for scraping
+func serve() {
+	quietProgress = true
+	metricsRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+
+	specs := *serveSchedule
+	implicit := len(specs) == 0
+	if implicit {
+		specs = map[string]string{strconv.Itoa(*serveRange): "@every " + serveInterval.String()}
+	}
+	scheduler, err := NewScheduler(specs, *serveJitter, *serveState, run)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	// without a schedule the first collection starts right away, like before schedules existed
+	scheduler.RunAtStart = implicit
+
+	server := &http.Server{Addr: *serveListen, Handler: metricsHandler()}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Fatal(err.Error())
+		}
+	}()
+	logger.Info("Serving metrics", zap.String("listen", *serveListen))
+
+	scheduler.Start(context.Background())
+}
+
+// metricsHandler serves the metrics registry at /metrics
+func metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	return mux
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCassette writes a cassette answering each url, keyed as ReplayTransport matches them, with status and body
+func writeTestCassette(t *testing.T, path string, responses map[string]CassetteResponse) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	encoder := json.NewEncoder(f)
+	for u, resp := range responses {
+		resp.Header = http.Header{"Content-Type": {"application/json"}}
+		if err := encoder.Encode(CassetteInteraction{Request: CassetteRequest{Method: "GET", URL: u}, Response: resp}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// writeTestRunCassette writes a cassette of a run discovering alice, bob and carol, of whom only alice's stats are ready
+func writeTestRunCassette(t *testing.T, path string) {
+	const api = "https://wakatime.com/api/v1"
+	ok := func(body string) CassetteResponse {
+		return CassetteResponse{StatusCode: 200, Status: "200 OK", Body: []byte(body)}
+	}
+	writeTestCassette(t, path, map[string]CassetteResponse{
+		api + "/users/current?api_key=REDACTED":                   ok(`{"data":{"id":"me"}}`),
+		api + "/users/current/stats/last_7_days?api_key=REDACTED": ok(`{"data":{}}`),
+		api + "/leaders?api_key=REDACTED&page=1":                  ok(`{"data":[{"user":{"id":"alice"}},{"user":{"id":"bob"}},{"user":{"id":"carol"}}],"page":1,"total_pages":1}`),
+		api + "/users/alice/stats/last_7_days?api_key=REDACTED":   ok(`{"data":{}}`),
+		api + "/users/bob/stats/last_7_days?api_key=REDACTED":     {StatusCode: 202, Status: "202 Accepted", Body: []byte(`{}`)},
+		api + "/users/carol/stats/last_7_days?api_key=REDACTED":   {StatusCode: 404, Status: "404 Not Found", Body: []byte(`{}`)},
+	})
+}
+
+func TestServe_MetricsAfterRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	cassette := filepath.Join(dir, "run.jsonl")
+	writeTestRunCassette(t, cassette)
+	replayed, quiet := *replayFile, quietProgress
+	defer func() { *replayFile, quietProgress = replayed, quiet }()
+	*replayFile, quietProgress = cassette, true
+
+	if err := run(30, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	// a replayed run leaves nothing behind but the cassette
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("replay left %d files in the working directory, want only the cassette", len(files))
+	}
+
+	server := httptest.NewServer(metricsHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`wakatime_collector_users_discovered{range="last_30_days"} 3`,
+		`wakatime_collector_users_collected{range="last_30_days"} 1`,
+		`wakatime_collector_users_remaining{range="last_30_days"} 2`,
+		`wakatime_collector_users_skipped_total{range="last_30_days",reason="accepted"} 1`,
+		`wakatime_collector_users_skipped_total{range="last_30_days",reason="not_found"} 1`,
+		`wakatime_collector_runs_total{range="last_30_days",result="success"} 1`,
+	} {
+		if !strings.Contains(string(body), want+"\n") {
+			t.Errorf("/metrics is missing %s", want)
+		}
+	}
+	if t.Failed() {
+		t.Logf("/metrics:\n%s", body)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/joomcode/errorx"
+	"github.com/nlopes/slack"
+	"go.uber.org/zap/zapcore"
+)
+
+// slackFormat is how an entry is rendered into a message
+type slackFormat string
+
+const (
+	// slackTextFormat is the encoded entry as the text of an attachment
+	slackTextFormat slackFormat = "text"
+	// slackBlocksFormat lays the entry out with Block Kit
+	slackBlocksFormat slackFormat = "blocks"
+)
+
+// Block Kit limits, longer texts are rejected rather than cut by Slack
+const (
+	slackHeaderLimit  = 150
+	slackMaxFields    = 10
+	slackFieldLimit   = 2000
+	slackSectionLimit = 3000
+)
+
+// slackMessage is a webhook or Web API payload, slack.WebhookMessage knows nothing about blocks
+type slackMessage struct {
+	// Channel, ThreadTS and TS are only sent to the Web API
+	Channel     string            `json:"channel,omitempty"`
+	ThreadTS    string            `json:"thread_ts,omitempty"`
+	TS          string            `json:"ts,omitempty"`
+	Text        string            `json:"text,omitempty"`
+	Attachments []slackAttachment `json:"attachments,omitempty"`
+}
+
+// slackAttachment carries blocks in an attachment so they keep the level's color
+type slackAttachment struct {
+	slack.Attachment
+	Blocks []slackBlock `json:"blocks,omitempty"`
+}
+
+// slackBlock is a header, section or context block
+type slackBlock struct {
+	Type     string            `json:"type"`
+	Text     *slackTextObject  `json:"text,omitempty"`
+	Fields   []slackTextObject `json:"fields,omitempty"`
+	Elements []slackTextObject `json:"elements,omitempty"`
+}
+
+type slackTextObject struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+func plainText(text string) slackTextObject {
+	return slackTextObject{Type: "plain_text", Text: text}
+}
+
+func markdownText(text string) slackTextObject {
+	return slackTextObject{Type: "mrkdwn", Text: text}
+}
+
+// blockFooter is shown below every message rendered with blocks
+type blockFooter struct {
+	Hostname string
+	Version  string
+	// Range is shown unless the entry has a range field of its own
+	Range string
+}
+
+// parseSlackFormats reads level=format pairs, a format applies from its level up
+func parseSlackFormats(pairs map[string]string) (map[zapcore.Level]slackFormat, error) {
+	formats := make(map[zapcore.Level]slackFormat, len(pairs))
+	for name, format := range pairs {
+		var level zapcore.Level
+		if err := level.UnmarshalText([]byte(name)); err != nil {
+			return nil, errorx.IllegalArgument.New("unknown slack level %q", name)
+		}
+		switch f := slackFormat(format); f {
+		case slackTextFormat, slackBlocksFormat:
+			formats[level] = f
+		default:
+			return nil, errorx.IllegalArgument.New("unknown slack format %q for level %s, pick from text, blocks", format, name)
+		}
+	}
+	return formats, nil
+}
+
+// formatFor picks the format configured for the closest level at or below level
+func formatFor(formats map[zapcore.Level]slackFormat, level zapcore.Level) slackFormat {
+	format, closest := slackTextFormat, zapcore.DebugLevel-1
+	for l, f := range formats {
+		if l <= level && l > closest {
+			format, closest = f, l
+		}
+	}
+	return format
+}
+
+// createBlocksPayload renders the message as a header, the fields as two columns,
+// multi-line values like the stack trace as code blocks and footer as context
+func createBlocksPayload(e *zapcore.Entry, fields []zapcore.Field, footer blockFooter) *slackMessage {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, field := range fields {
+		field.AddTo(enc)
+	}
+	header := plainText(truncate(e.Message, slackHeaderLimit))
+	blocks := []slackBlock{{Type: "header", Text: &header}}
+	var columns []slackTextObject
+	var details []slackBlock
+	hidden := 0
+	rangeName := footer.Range
+	for _, key := range sortedKeys(enc.Fields) {
+		value := fieldText(enc.Fields[key])
+		if key == "range" {
+			rangeName = value
+			continue
+		}
+		switch {
+		case strings.Contains(value, "\n"):
+			details = append(details, codeBlock(key, value))
+		case len(columns) < slackMaxFields:
+			columns = append(columns, markdownText(truncate(fmt.Sprintf("*%s*\n%s", key, value), slackFieldLimit)))
+		default:
+			hidden++
+		}
+	}
+	if len(columns) > 0 {
+		blocks = append(blocks, slackBlock{Type: "section", Fields: columns})
+	}
+	if e.Caller.Defined {
+		blocks = append(blocks, codeBlock("caller", e.Caller.TrimmedPath()))
+	}
+	if e.Stack != "" {
+		blocks = append(blocks, codeBlock("stack", e.Stack))
+	}
+	blocks = append(blocks, details...)
+
+	var context []slackTextObject
+	for _, part := range []string{footer.Hostname, footer.Version, rangeName} {
+		if part != "" {
+			context = append(context, markdownText(part))
+		}
+	}
+	if hidden > 0 {
+		context = append(context, markdownText(fmt.Sprintf("%d more fields", hidden)))
+	}
+	if len(context) > 0 {
+		blocks = append(blocks, slackBlock{Type: "context", Elements: context})
+	}
+
+	attachment := slackAttachment{Blocks: blocks}
+	attachment.Fallback = e.Message
+	attachment.Color = LevelColorMap[e.Level]
+	return &slackMessage{Attachments: []slackAttachment{attachment}}
+}
+
+// codeBlock is a section titled title showing body preformatted, Slack folds long ones behind "Show more"
+func codeBlock(title, body string) slackBlock {
+	head := fmt.Sprintf("*%s*\n```", title)
+	text := markdownText(head + truncate(body, slackSectionLimit-len(head)-3) + "```")
+	return slackBlock{Type: "section", Text: &text}
+}
+
+// fieldText formats a field value, objects and arrays as JSON
+func fieldText(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case map[string]interface{}, []interface{}:
+		if b, err := json.Marshal(v); err == nil {
+			return string(b)
+		}
+	}
+	return fmt.Sprint(value)
+}
+
+// truncate cuts s to at most limit bytes without splitting a rune, marking the cut with an ellipsis
+func truncate(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	const ellipsis = "…"
+	cut := limit - len(ellipsis)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + ellipsis
+}
+
+// createSummaryPayload renders a run summary with the numbers as fields and the comparison to
+// the previous run as context
+func createSummaryPayload(summary *RunSummary) *slackMessage {
+	header := plainText(truncate(summary.Title(), slackHeaderLimit))
+	var facts []slackTextObject
+	for _, fact := range summaryFacts(summary) {
+		facts = append(facts, markdownText(fmt.Sprintf("*%s*\n%s", fact[0], fact[1])))
+	}
+	blocks := []slackBlock{{Type: "header", Text: &header}, {Type: "section", Fields: facts}}
+	if summary.Error != "" {
+		blocks = append(blocks, codeBlock("error", summary.Error))
+	}
+	var context []slackTextObject
+	for _, part := range []string{summary.Comparison(), summary.Version} {
+		if part != "" {
+			context = append(context, markdownText(part))
+		}
+	}
+	if len(context) > 0 {
+		blocks = append(blocks, slackBlock{Type: "context", Elements: context})
+	}
+
+	attachment := slackAttachment{Blocks: blocks}
+	attachment.Fallback = summary.Title()
+	attachment.Color = LevelColorMap[zapcore.InfoLevel]
+	if summary.Result != runSucceeded {
+		attachment.Color = LevelColorMap[zapcore.ErrorLevel]
+	}
+	return &slackMessage{Attachments: []slackAttachment{attachment}}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestCreateBlocksPayload(t *testing.T) {
+	entry := zapcore.Entry{
+		Level:   zapcore.ErrorLevel,
+		Message: "stats request failed",
+		Caller:  zapcore.NewEntryCaller(0, "/src/wakatime-collector/main.go", 42, true),
+		Stack:   "main.run\n\t/src/main.go:42",
+	}
+	fields := []zapcore.Field{
+		zap.String("user", "alice"),
+		zap.Int("attempt", 3),
+		zap.String("range", "last_30_days"),
+		zap.Error(errors.New("timeout")),
+		zap.String("response", "line one\nline two"),
+	}
+	payload := createBlocksPayload(&entry, fields, blockFooter{Hostname: "node-1", Version: "v1.2.0", Range: "last_7_days"})
+
+	attachment := payload.Attachments[0]
+	if attachment.Color != "danger" || attachment.Fallback != entry.Message {
+		t.Errorf("attachment color %q fallback %q", attachment.Color, attachment.Fallback)
+	}
+	var types []string
+	for _, block := range attachment.Blocks {
+		types = append(types, block.Type)
+	}
+	if want := []string{"header", "section", "section", "section", "section", "context"}; !reflect.DeepEqual(types, want) {
+		t.Fatalf("blocks %v, want %v", types, want)
+	}
+	blocks := attachment.Blocks
+	if blocks[0].Text.Type != "plain_text" || blocks[0].Text.Text != entry.Message {
+		t.Errorf("header %+v", blocks[0].Text)
+	}
+	var columns []string
+	for _, field := range blocks[1].Fields {
+		columns = append(columns, field.Text)
+	}
+	if want := []string{"*attempt*\n3", "*error*\ntimeout", "*user*\nalice"}; !reflect.DeepEqual(columns, want) {
+		t.Errorf("fields %q, want %q", columns, want)
+	}
+	for i, want := range []string{"*caller*\n```wakatime-collector/main.go:42```", "*stack*\n```" + entry.Stack + "```", "*response*\n```line one\nline two```"} {
+		if got := blocks[2+i].Text.Text; got != want {
+			t.Errorf("code block %d is %q, want %q", i, got, want)
+		}
+	}
+	var footer []string
+	for _, element := range blocks[5].Elements {
+		footer = append(footer, element.Text)
+	}
+	// the entry's range field wins over the configured one
+	if want := []string{"node-1", "v1.2.0", "last_30_days"}; !reflect.DeepEqual(footer, want) {
+		t.Errorf("footer %q, want %q", footer, want)
+	}
+
+	// blocks survive a round trip through the dead letter file
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded slackMessage
+	if err := json.Unmarshal(raw, &decoded); err != nil || !reflect.DeepEqual(&decoded, payload) {
+		t.Errorf("decoded %+v, %v", decoded, err)
+	}
+}
+
+func TestCreateBlocksPayload_Limits(t *testing.T) {
+	var fields []zapcore.Field
+	for i := 0; i < slackMaxFields+3; i++ {
+		fields = append(fields, zap.Int(fmt.Sprintf("field%02d", i), i))
+	}
+	entry := zapcore.Entry{Level: zapcore.WarnLevel, Message: strings.Repeat("é", slackHeaderLimit)}
+	blocks := createBlocksPayload(&entry, fields, blockFooter{}).Attachments[0].Blocks
+
+	if header := blocks[0].Text.Text; len(header) > slackHeaderLimit || !strings.HasSuffix(header, "…") {
+		t.Errorf("header of %d bytes isn't cut at %d", len(header), slackHeaderLimit)
+	}
+	if len(blocks[1].Fields) != slackMaxFields {
+		t.Errorf("%d fields shown, want %d", len(blocks[1].Fields), slackMaxFields)
+	}
+	if footer := blocks[len(blocks)-1]; footer.Elements[0].Text != "3 more fields" {
+		t.Errorf("footer %+v doesn't count the hidden fields", footer.Elements)
+	}
+}
+
+func TestFormatFor(t *testing.T) {
+	formats, err := parseSlackFormats(map[string]string{"warn": "blocks", "fatal": "text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		level zapcore.Level
+		want  slackFormat
+	}{
+		{zapcore.InfoLevel, slackTextFormat},
+		{zapcore.WarnLevel, slackBlocksFormat},
+		{zapcore.ErrorLevel, slackBlocksFormat},
+		{zapcore.FatalLevel, slackTextFormat},
+	}
+	for _, tt := range tests {
+		if got := formatFor(formats, tt.level); got != tt.want {
+			t.Errorf("formatFor(%s) = %s, want %s", tt.level, got, tt.want)
+		}
+	}
+
+	for _, pairs := range []map[string]string{{"loud": "text"}, {"error": "html"}} {
+		if _, err := parseSlackFormats(pairs); err == nil {
+			t.Errorf("parseSlackFormats(%v) accepted it", pairs)
+		}
+	}
+}
+
+func TestSlackCore_RendersBlocksWithContextFields(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+	core := newTestSlackCore(server.URL)
+	core.Formats = map[zapcore.Level]slackFormat{zapcore.ErrorLevel: slackBlocksFormat}
+	clone := core.With([]zapcore.Field{zap.String("user", "bob")})
+
+	clone.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "failed"}, []zapcore.Field{zap.Int("attempt", 2)})
+	clone.Write(zapcore.Entry{Level: zapcore.WarnLevel, Message: "slow"}, nil)
+	clone.Sync()
+
+	posts := server.Posts()
+	if len(posts) != 1 || len(posts[0].Attachments) != 2 {
+		t.Fatalf("posted %+v, want one message with both entries", posts)
+	}
+	if fields := posts[0].Attachments[0].Blocks[1].Fields; len(fields) != 2 || fields[1].Text != "*user*\nbob" {
+		t.Errorf("the error's fields are %+v, want the clone's fields too", fields)
+	}
+	if warning := posts[0].Attachments[1]; warning.Blocks != nil || !strings.HasPrefix(warning.Text, "slow") {
+		t.Errorf("the warning below the blocks level was rendered as %+v", warning)
+	}
+}
+
+func TestSlackCore_NotifyRun(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+	core := newTestSlackCore(server.URL)
+
+	started := time.Now()
+	summary := &RunSummary{Range: "last_7_days", Started: started, Finished: started.Add(time.Minute), Result: runFailed, Error: "leaderboard unavailable"}
+	if err := core.NotifyRun(summary); err != nil {
+		t.Fatal(err)
+	}
+	posts := server.Posts()
+	if len(posts) != 1 {
+		t.Fatalf("posted %d messages, want the summary", len(posts))
+	}
+	attachment := posts[0].Attachments[0]
+	if attachment.Color != "danger" || attachment.Blocks[0].Text.Text != "Run failed: last_7_days" {
+		t.Errorf("summary posted as %+v", attachment)
+	}
+	if errorBlock := attachment.Blocks[2]; !strings.Contains(errorBlock.Text.Text, summary.Error) {
+		t.Errorf("the run's error isn't shown: %+v", errorBlock)
+	}
+}
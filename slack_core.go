@@ -1,29 +1,43 @@
 package main
 
 import (
-	"fmt"
-	"github.com/joomcode/errorx"
-	"github.com/nlopes/slack"
-	"go.uber.org/zap/zapcore"
-	"sync"
+	"context"
+	"encoding/json"
+	"net/http"
 	"sync/atomic"
 	"time"
+
+	"github.com/joomcode/errorx"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// slackMaxAttachments is the most attachments Slack shows in one message
+	slackMaxAttachments = 100
+	// slackDedupFlushInterval is how often summaries of repeated entries are looked for
+	slackDedupFlushInterval = 30 * time.Second
 )
 
 var (
-	SlackTooManyFailures = errorx.ExternalError.New("Slack API max failures")
+	slackNamespace   = errorx.NewNamespace("slack")
+	SlackCircuitOpen = slackNamespace.NewType("circuit_open")
 )
 
 func NewSlackCore(hookURL string, encoder zapcore.Encoder, level zapcore.Level) *SlackCore {
 	return &SlackCore{
 		HookURL:       hookURL,
+		APIURL:        slackAPIURL,
 		AcceptedLevel: level,
 		encoder:       encoder,
-		entryChan:     make(chan *slack.WebhookMessage, 100),
-		quitChan:      make(chan string),
-		totalErrors:   0,
-		failErrors:    10,
-		wait:          new(sync.WaitGroup),
+		Timeout:       10 * time.Second,
+		BatchWindow:   2 * time.Second,
+		MaxBatch:      20,
+		RetryFor:      time.Minute,
+		limiter:       newTokenBucket(1, 1),
+		dedup:         newDeduper(10*time.Minute, nil),
+		breaker:       newCircuitBreaker(5, time.Minute),
+		queue:         newNotifyQueue[*slackMessage](100),
+		thread:        newSlackThread(),
 	}
 }
 
@@ -35,6 +49,10 @@ type SlackCore struct {
 	AcceptedLevel zapcore.Level
 	encoder       zapcore.Encoder
 	HookURL       string // Webhook URL
+	// with a bot Token messages are posted to Channel through the Web API at APIURL instead,
+	// which lets a run's alerts be replies in one thread
+	Token  string
+	APIURL string
 
 	// slack post parameters
 	Username  string // display name
@@ -45,39 +63,100 @@ type SlackCore struct {
 	FieldHeader string        // a header above field data
 	Timeout     time.Duration // request timeout
 
-	once sync.Once
+	// Formats picks how entries are rendered from a level up, entries below every level are text
+	Formats map[zapcore.Level]slackFormat
+	// Footer is shown below messages rendered with blocks
+	Footer blockFooter
+	// fields added by With, blocks lay them out besides the entry's own
+	fields []zapcore.Field
 
-	entryChan chan *slack.WebhookMessage
-	quitChan  chan string
-	wait      *sync.WaitGroup
+	// entries arriving within BatchWindow of the first are posted together,
+	// up to MaxBatch entries per message
+	BatchWindow time.Duration
+	MaxBatch    int
+	// limiter spaces out posts, Slack asks for no more than one message per second
+	limiter *tokenBucket
+	// dedup folds repeats of an entry into a "repeated N times" summary
+	dedup *deduper
+	// RetryFor is how long a failing post is retried with exponential backoff
+	RetryFor time.Duration
+	// breaker stops posting after consecutive failures until its cool-down is over
+	breaker *circuitBreaker
+	// deadLetter spools messages that couldn't be posted, they are replayed on the next start
+	deadLetter *deadLetter
 
-	totalErrors int64
-	failErrors  int64
+	queue  *notifyQueue[*slackMessage]
+	thread *slackThread
 }
 
 func (sh *SlackCore) With(fields []zapcore.Field) zapcore.Core {
 	clone := sh.clone()
+	clone.encoder = sh.encoder.Clone()
+	clone.fields = append(sh.fields[:len(sh.fields):len(sh.fields)], fields...)
 	for _, field := range fields {
 		field.AddTo(clone.encoder)
 	}
 	return clone
 }
 
+// Sync waits for queued entries and thread updates to be posted and posts summaries of every repeated entry
 func (sh *SlackCore) Sync() error {
-	sh.wait.Wait()
-	return nil
+	sh.queue.wait()
+	sh.thread.waitUpdates()
+	return sh.postSummaries(sh.dedup.flush(true))
+}
+
+// Close stops queueing entries and waits for the queued ones to be posted until ctx is done,
+// the ones still queued by then are spooled to the dead letter file. Entries written
+// afterwards are spooled too, besides fatal ones which are posted right away.
+func (sh *SlackCore) Close(ctx context.Context) error {
+	left, closing, err := sh.queue.close(ctx, sh.startWorker, sh.thread.waitUpdates)
+	if !closing {
+		return nil
+	}
+	if err == nil {
+		return sh.postSummaries(sh.dedup.flush(true))
+	}
+	// whatever the worker is posting right now is spooled by send if it fails
+	for _, payload := range left {
+		sh.deadLetter.Append(payload)
+	}
+	return errorx.Decorate(err, "closed with %d slack messages still queued", len(left))
+}
+
+// postSummaries posts one message listing how often each entry was repeated
+func (sh *SlackCore) postSummaries(summaries []*dedupSummary) error {
+	if len(summaries) == 0 {
+		return nil
+	}
+	batch := make([]*slackMessage, 0, len(summaries))
+	for _, summary := range summaries {
+		batch = append(batch, createPayloadMessage(&summary.entry, summary.Message()))
+	}
+	return sh.send(mergePayloads(batch))
 }
 
 func (sh *SlackCore) clone() *SlackCore {
 	return &SlackCore{
 		HookURL:       sh.HookURL,
+		Token:         sh.Token,
+		Channel:       sh.Channel,
+		APIURL:        sh.APIURL,
 		AcceptedLevel: sh.AcceptedLevel,
 		encoder:       sh.encoder,
-		entryChan:     make(chan *slack.WebhookMessage),
-		quitChan:      make(chan string),
-		wait:          new(sync.WaitGroup),
-		totalErrors:   0,
-		failErrors:    sh.failErrors,
+		Timeout:       sh.Timeout,
+		Formats:       sh.Formats,
+		Footer:        sh.Footer,
+		fields:        sh.fields,
+		BatchWindow:   sh.BatchWindow,
+		MaxBatch:      sh.MaxBatch,
+		RetryFor:      sh.RetryFor,
+		limiter:       sh.limiter,
+		dedup:         sh.dedup,
+		breaker:       sh.breaker,
+		deadLetter:    sh.deadLetter,
+		queue:         sh.queue,
+		thread:        sh.thread,
 	}
 }
 
@@ -93,92 +172,248 @@ func (sh *SlackCore) Enabled(lvl zapcore.Level) bool {
 }
 
 func (sh *SlackCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
-	sh.once.Do(func() {
-		go sh.startWorker()
-	})
+	if entry.Level < zapcore.FatalLevel {
+		post, summary := sh.dedup.admit(entry, sh.fields, fields)
+		if summary != nil {
+			if err := sh.enqueue(createPayloadMessage(&summary.entry, summary.Message())); err != nil {
+				return err
+			}
+		}
+		if !post {
+			return nil
+		}
+	}
 
-	failures := atomic.LoadInt64(&sh.totalErrors)
-	if failures >= sh.failErrors {
-		return errorx.Decorate(SlackTooManyFailures, fmt.Sprintf("Reached maximum threshold of %d", failures))
+	payload, err := sh.render(entry, fields)
+	if err != nil {
+		return err
 	}
+	if entry.Level >= zapcore.FatalLevel {
+		sh.queue.wait()
+		return sh.send(payload)
+	}
+	return sh.enqueue(payload)
+}
 
-	// Generate the message.
+// render creates the message for entry in the format configured for its level
+func (sh *SlackCore) render(entry zapcore.Entry, fields []zapcore.Field) (*slackMessage, error) {
+	if formatFor(sh.Formats, entry.Level) == slackBlocksFormat {
+		return createBlocksPayload(&entry, append(sh.fields[:len(sh.fields):len(sh.fields)], fields...), sh.Footer), nil
+	}
 	buffer, err := sh.encoder.EncodeEntry(entry, fields)
 	if err != nil {
-		return errorx.Decorate(err, "failed to encode log entry")
+		return nil, errorx.Decorate(err, "failed to encode log entry")
 	}
+	defer buffer.Free()
+	return createPayloadMessage(&entry, buffer.String()), nil
+}
 
-	message := buffer.String()
-	payload := createPayloadMessage(&entry, message)
-	if entry.Level >= zapcore.FatalLevel {
-		sh.wait.Wait()
-		err := slack.PostWebhook(sh.HookURL, payload)
-		return err
+// enqueue hands payload to the worker, Sync waits until it was posted.
+// Once closed, or while the worker is too far behind, payload is spooled to the
+// dead letter file instead so logging never waits on Slack.
+func (sh *SlackCore) enqueue(payload *slackMessage) error {
+	if err := sh.queue.push(payload, sh.startWorker); err != nil {
+		return sh.spool(payload, err)
 	}
-	sh.entryChan <- payload
-	sh.wait.Add(1)
 	return nil
 }
 
 func (sh *SlackCore) GetHook() func(zapcore.Entry) error {
 	return func(e zapcore.Entry) error {
-		sh.once.Do(func() {
-			go sh.startWorker()
-		})
 		if e.Level < sh.AcceptedLevel {
 			return nil
 		}
 		payload := createPayload(&e)
 		if e.Level == zapcore.PanicLevel {
 			sh.Sync()
-			err := slack.PostWebhook(sh.HookURL, payload)
-			return err
+			return sh.send(payload)
 		}
-		sh.entryChan <- payload
-		return nil
+		return sh.enqueue(payload)
 	}
 }
 
-func (sh *SlackCore) startWorker() error {
+// startWorker posts queued entries until Close, one worker serves a SlackCore and its clones
+func (sh *SlackCore) startWorker() {
+	q := sh.queue
+	defer close(q.done)
+	flush := time.NewTicker(slackDedupFlushInterval)
+	defer flush.Stop()
 	for {
 		select {
-		case e := <-sh.entryChan:
-			err := slack.PostWebhook(sh.HookURL, e)
-			if err != nil {
-				// fmt.Println(err)
-				atomic.AddInt64(&sh.totalErrors, 1)
+		case <-flush.C:
+			sh.postSummaries(sh.dedup.flush(false))
+		case e := <-q.items:
+			batch := sh.collectBatch(e)
+			select {
+			case <-q.quit:
+				// Close gave up waiting while the batch was being collected
+				sh.spool(mergePayloads(batch), nil)
+			default:
+				sh.send(mergePayloads(batch))
+			}
+			q.add(-len(batch))
+		case <-q.quit:
+			return
+		}
+	}
+}
+
+// collectBatch gathers the entries queued within BatchWindow of first
+func (sh *SlackCore) collectBatch(first *slackMessage) []*slackMessage {
+	batch := []*slackMessage{first}
+	if sh.BatchWindow <= 0 {
+		return batch
+	}
+	timer := time.NewTimer(sh.BatchWindow)
+	defer timer.Stop()
+	for len(batch) < sh.MaxBatch && len(batch) < slackMaxAttachments {
+		select {
+		case e := <-sh.queue.items:
+			batch = append(batch, e)
+		case <-timer.C:
+			return batch
+		case <-sh.queue.quit:
+			return batch
+		}
+	}
+	return batch
+}
+
+// mergePayloads combines the attachments of every payload into one message
+func mergePayloads(batch []*slackMessage) *slackMessage {
+	if len(batch) == 1 {
+		return batch[0]
+	}
+	// replies stay in the thread of the first message
+	merged := &slackMessage{ThreadTS: batch[0].ThreadTS}
+	for _, payload := range batch {
+		merged.Attachments = append(merged.Attachments, payload.Attachments...)
+	}
+	return merged
+}
+
+// Replay queues the messages spooled to the dead letter file by an earlier run,
+// those that don't fit the queue stay spooled
+func (sh *SlackCore) Replay() error {
+	payloads, err := sh.deadLetter.Take()
+	if err != nil {
+		return errorx.Decorate(err, "failed to read slack dead letters")
+	}
+	for i, payload := range payloads {
+		if sh.queue.push(payload, sh.startWorker) == nil {
+			continue
+		}
+		// what doesn't fit the queue waits for the next start rather than holding up logging
+		for _, payload := range payloads[i:] {
+			if err := sh.deadLetter.Append(payload); err != nil {
+				return errorx.Decorate(err, "failed to spool slack dead letters again")
 			}
-			sh.wait.Done()
-		case <-sh.quitChan:
+		}
+		return nil
+	}
+	return nil
+}
+
+// Discard stops spooling, alerts that can't be posted from now on are dropped
+func (sh *SlackCore) Discard() {
+	sh.deadLetter.Discard()
+}
+
+// send posts payload, retrying with backoff while the circuit breaker allows it.
+// Messages that couldn't be posted are spooled to the dead letter file, besides
+// those Slack rejected which would only be rejected again when replayed.
+func (sh *SlackCore) send(payload *slackMessage) error {
+	var err error = SlackCircuitOpen.New("not posting until the cool-down is over")
+	if sh.breaker.Allow() {
+		err = sh.retry(payload)
+		if err == nil {
+			sh.breaker.Success()
 			return nil
 		}
+		sh.breaker.Failure()
+	}
+	atomic.AddInt64(&sh.queue.totalErrors, 1)
+	if errorx.IsOfType(err, NotifyRejected) {
+		return err
+	}
+	return sh.spool(payload, err)
+}
+
+// spool saves payload to the dead letter file when it couldn't be posted because of cause
+func (sh *SlackCore) spool(payload *slackMessage, cause error) error {
+	if err := sh.deadLetter.Append(payload); err != nil {
+		return errorx.DecorateMany("failed to post or spool slack message", cause, err)
+	}
+	return cause
+}
+
+// retry delivers payload until it succeeds, is rejected or RetryFor has passed
+func (sh *SlackCore) retry(payload *slackMessage) error {
+	return retryDelivery(sh.RetryFor, func() error {
+		return sh.deliver(payload)
+	})
+}
+
+// deliver posts payload to the webhook, or as a reply in the run's thread when there is a bot token
+func (sh *SlackCore) deliver(payload *slackMessage) error {
+	if sh.Token == "" {
+		return sh.rateLimited(func(client *http.Client) error {
+			return postWebhook(client, sh.HookURL, payload)
+		})
+	}
+	reply := *payload
+	reply.Channel = sh.Channel
+	if reply.ThreadTS == "" {
+		reply.ThreadTS = sh.thread.TS()
+	}
+	return sh.rateLimited(func(client *http.Client) error {
+		_, err := callSlackAPI(client, sh.APIURL+"chat.postMessage", sh.Token, &reply)
+		return err
+	})
+}
+
+// rateLimited calls post once the rate limit allows, waiting out any Retry-After Slack answers with
+func (sh *SlackCore) rateLimited(post func(client *http.Client) error) error {
+	client := &http.Client{Timeout: sh.Timeout}
+	return withRateLimit(sh.limiter, func() error {
+		return post(client)
+	})
+}
+
+// postWebhook posts payload to url, a 429 response is returned as NotifyRateLimited
+// with how long to wait as its retry_after property
+func postWebhook(client *http.Client, url string, payload *slackMessage) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return errorx.Decorate(err, "marshal failed")
 	}
+	return postJSON(client, url, raw)
 }
 
-func createPayload(e *zapcore.Entry) *slack.WebhookMessage {
+func createPayload(e *zapcore.Entry) *slackMessage {
 	color, _ := LevelColorMap[e.Level]
 
-	attachment := slack.Attachment{}
+	attachment := slackAttachment{}
 	attachment.Text = e.Message
 	attachment.Fallback = e.Message
 	attachment.Color = color
 
-	payload := slack.WebhookMessage{
-		Attachments: []slack.Attachment{attachment},
+	payload := slackMessage{
+		Attachments: []slackAttachment{attachment},
 	}
 	return &payload
 }
 
-func createPayloadMessage(e *zapcore.Entry, message string) *slack.WebhookMessage {
+func createPayloadMessage(e *zapcore.Entry, message string) *slackMessage {
 	color, _ := LevelColorMap[e.Level]
 
-	attachment := slack.Attachment{}
+	attachment := slackAttachment{}
 	attachment.Text = message
 	attachment.Fallback = message
 	attachment.Color = color
 
-	payload := slack.WebhookMessage{
-		Attachments: []slack.Attachment{attachment},
+	payload := slackMessage{
+		Attachments: []slackAttachment{attachment},
 	}
 	return &payload
 }
@@ -1,10 +1,404 @@
 package main
 
 import (
-	"go.uber.org/zap/zapcore"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 func TestCore_CheckZapCoreInterface(t *testing.T) {
 	var _ zapcore.Core = &SlackCore{}
 }
+
+// Posts decodes the webhooks posted to s
+func (s *recordingServer) Posts() []slackMessage {
+	var posts []slackMessage
+	for _, request := range s.Requests() {
+		var payload slackMessage
+		json.Unmarshal(request.Body, &payload)
+		posts = append(posts, payload)
+	}
+	return posts
+}
+
+func newTestSlackCore(url string) *SlackCore {
+	core := NewSlackCore(url, NewKVEncoder(zapcore.EncoderConfig{MessageKey: "msg"}), zapcore.InfoLevel)
+	core.BatchWindow = 50 * time.Millisecond
+	core.limiter = newTokenBucket(100, 1)
+	core.RetryFor = 0
+	return core
+}
+
+func TestSlackCore_BatchesBursts(t *testing.T) {
+	server := newRecordingServer(http.StatusTooManyRequests)
+	defer server.Close()
+	core := newTestSlackCore(server.URL)
+
+	for i := 0; i < 5; i++ {
+		if err := core.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: fmt.Sprint("failed ", i)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	core.Sync()
+
+	posts := server.Posts()
+	if len(posts) != 1 || len(posts[0].Attachments) != 5 {
+		t.Fatalf("posted %d messages, want 1 with 5 attachments: %+v", len(posts), posts)
+	}
+	if core.queue.totalErrors != 0 {
+		t.Errorf("a 429 honoured with a retry counted as %d failures", core.queue.totalErrors)
+	}
+}
+
+func TestSlackCore_FoldsRepeatsAcrossClones(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+	core := newTestSlackCore(server.URL)
+	clone := core.With(nil)
+
+	entry := zapcore.Entry{Level: zapcore.ErrorLevel, Message: "stats request failed"}
+	for _, c := range []zapcore.Core{core, clone, core, clone} {
+		if err := c.Write(entry, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// clones share the queue so syncing either one waits for every entry
+	clone.Sync()
+
+	var texts []string
+	for _, post := range server.Posts() {
+		for _, attachment := range post.Attachments {
+			texts = append(texts, attachment.Text)
+		}
+	}
+	if len(texts) != 2 || !strings.Contains(texts[1], "stats request failed (repeated 3 times in") {
+		t.Errorf("posted %q, want the entry once and a summary of 3 repeats", texts)
+	}
+}
+
+func TestSlackCore_KeepsClonesWithOtherFieldsApart(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+	core := newTestSlackCore(server.URL)
+	week := core.With([]zapcore.Field{zap.String("range", "last_7_days")})
+	year := core.With([]zapcore.Field{zap.String("range", "last_year")})
+
+	entry := zapcore.Entry{Level: zapcore.ErrorLevel, Message: "stats request failed"}
+	for _, c := range []zapcore.Core{week, year, week, year} {
+		if err := c.Write(entry, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	core.Sync()
+
+	var texts []string
+	for _, post := range server.Posts() {
+		for _, attachment := range post.Attachments {
+			texts = append(texts, attachment.Text)
+		}
+	}
+	if len(texts) != 4 || strings.Count(strings.Join(texts, "\n"), "repeated 1 times") != 2 {
+		t.Errorf("posted %q, want the entry and a summary of its repeat for each range", texts)
+	}
+}
+
+func TestSlackCore_RetriesFailedPosts(t *testing.T) {
+	server := newRecordingServer(http.StatusInternalServerError, http.StatusInternalServerError)
+	defer server.Close()
+	core := newTestSlackCore(server.URL)
+	core.RetryFor = 10 * time.Second
+
+	if err := core.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "failed"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	core.Sync()
+	if posts := server.Posts(); len(posts) != 1 || core.queue.totalErrors != 0 {
+		t.Errorf("posted %d messages with %d failures, want the retry to get through", len(posts), core.queue.totalErrors)
+	}
+}
+
+func TestSlackCore_SpoolsAndReplays(t *testing.T) {
+	dir := tempDir(t)
+	spool := &deadLetter{path: filepath.Join(dir, "slack.deadletter")}
+
+	down := newRecordingServer()
+	down.reply = func(w http.ResponseWriter, r *http.Request, n int) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	defer down.Close()
+	core := newTestSlackCore(down.URL)
+	core.deadLetter = spool
+	for _, message := range []string{"first", "second"} {
+		core.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: message}, nil)
+		core.Sync()
+	}
+	if core.queue.totalErrors != 2 {
+		t.Fatalf("counted %d failures, want 2", core.queue.totalErrors)
+	}
+
+	up := newRecordingServer()
+	defer up.Close()
+	core = newTestSlackCore(up.URL)
+	core.deadLetter = spool
+	if err := core.Replay(); err != nil {
+		t.Fatal(err)
+	}
+	core.Sync()
+	posts := up.Posts()
+	if len(posts) != 1 || len(posts[0].Attachments) != 2 || strings.TrimSpace(posts[0].Attachments[1].Text) != "second" {
+		t.Errorf("replayed %+v, want both spooled messages", posts)
+	}
+	if payloads, _ := spool.Take(); len(payloads) != 0 {
+		t.Errorf("%d messages left in the dead letter file after replaying", len(payloads))
+	}
+}
+
+func TestSlackCore_DiscardStopsSpooling(t *testing.T) {
+	down := newRecordingServer()
+	down.reply = func(w http.ResponseWriter, r *http.Request, n int) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	defer down.Close()
+	spool := &deadLetter{path: filepath.Join(tempDir(t), "slack.deadletter")}
+	core := newTestSlackCore(down.URL)
+	core.deadLetter = spool
+	route := newRouteCore(&alertRoute{}, core)
+
+	// like the collector does once another instance took over the working directory
+	route.Discard()
+	core.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "failed"}, nil)
+	core.Sync()
+	if payloads, _ := spool.Take(); len(payloads) != 0 {
+		t.Errorf("spooled %d messages after discarding, want none", len(payloads))
+	}
+}
+
+func TestSlackCore_DropsRejected(t *testing.T) {
+	server := newRecordingServer(http.StatusBadRequest)
+	defer server.Close()
+	spool := &deadLetter{path: filepath.Join(tempDir(t), "slack.deadletter")}
+	core := newTestSlackCore(server.URL)
+	core.RetryFor = 10 * time.Second
+	core.deadLetter = spool
+
+	core.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "malformed"}, nil)
+	core.Sync()
+	if core.queue.totalErrors != 1 {
+		t.Errorf("counted %d failures, want the rejection", core.queue.totalErrors)
+	}
+	if payloads, _ := spool.Take(); len(payloads) != 0 {
+		t.Errorf("spooled %d rejected messages, want none", len(payloads))
+	}
+}
+
+func TestSlackCore_SpoolsWhenQueueFull(t *testing.T) {
+	spool := &deadLetter{path: filepath.Join(tempDir(t), "slack.deadletter")}
+	core := newTestSlackCore("http://127.0.0.1:1")
+	core.deadLetter = spool
+	core.queue = newNotifyQueue[*slackMessage](1)
+	// the worker never starts so nothing leaves the queue
+	core.queue.start.Do(func() {})
+
+	if err := core.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "queued"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- core.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "overflow"}, nil)
+	}()
+	select {
+	case err := <-done:
+		if !errorx.IsOfType(err, NotifyQueueFull) {
+			t.Errorf("writing to a full queue returned %v, want NotifyQueueFull", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing to a full queue blocked")
+	}
+	payloads, _ := spool.Take()
+	if len(payloads) != 1 || strings.TrimSpace(payloads[0].Attachments[0].Text) != "overflow" {
+		t.Errorf("spooled %+v, want the message that didn't fit", payloads)
+	}
+}
+
+func TestSlackCore_Close(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+	spool := &deadLetter{path: filepath.Join(tempDir(t), "slack.deadletter")}
+	core := newTestSlackCore(server.URL)
+	core.deadLetter = spool
+	clone := core.With([]zapcore.Field{zap.String("range", "last_7_days")})
+
+	clone.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "queued"}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := core.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if posts := server.Posts(); len(posts) != 1 {
+		t.Errorf("posted %d messages before Close returned, want the queued one", len(posts))
+	}
+	select {
+	case <-core.queue.done:
+	default:
+		t.Error("the worker is still running after Close")
+	}
+
+	if err := clone.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "late"}, nil); !errorx.IsOfType(err, NotifyClosed) {
+		t.Errorf("writing to a closed clone returned %v", err)
+	}
+	if payloads, _ := spool.Take(); len(payloads) != 1 {
+		t.Errorf("spooled %d messages written after Close, want 1", len(payloads))
+	}
+}
+
+func TestSlackCore_CloseSpoolsAfterDeadline(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+	spool := &deadLetter{path: filepath.Join(tempDir(t), "slack.deadletter")}
+	core := newTestSlackCore(server.URL)
+	core.deadLetter = spool
+	// the worker sits in the batch window while the deadline passes
+	core.BatchWindow = time.Minute
+
+	for _, message := range []string{"first", "second", "third"} {
+		core.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: message}, nil)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := core.Close(ctx); err == nil {
+		t.Error("Close didn't report the messages it had to spool")
+	}
+	<-core.queue.done
+	var texts []string
+	payloads, _ := spool.Take()
+	for _, payload := range payloads {
+		for _, attachment := range payload.Attachments {
+			texts = append(texts, strings.TrimSpace(attachment.Text))
+		}
+	}
+	if len(texts) != 3 || len(server.Posts()) != 0 {
+		t.Errorf("spooled %q and posted %d messages, want every message spooled", texts, len(server.Posts()))
+	}
+}
+
+func TestSlackCore_ReplayKeepsWhatDoesntFit(t *testing.T) {
+	spool := &deadLetter{path: filepath.Join(tempDir(t), "slack.deadletter")}
+	for _, message := range []string{"first", "second", "third"} {
+		spool.Append(createPayloadMessage(&zapcore.Entry{Level: zapcore.ErrorLevel}, message))
+	}
+	core := newTestSlackCore("http://127.0.0.1:1")
+	core.deadLetter = spool
+	core.queue = newNotifyQueue[*slackMessage](1)
+	// the worker never starts so the replay can't queue everything
+	core.queue.start.Do(func() {})
+
+	if err := core.Replay(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := core.Close(ctx); err == nil {
+		t.Error("Close didn't report the messages it had to spool")
+	}
+	if payloads, _ := spool.Take(); len(payloads) != 3 {
+		t.Errorf("spooled %d messages, want the 3 replayed ones kept for the next start", len(payloads))
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newCircuitBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	b.Failure()
+	if !b.Allow() {
+		t.Error("opened before reaching the threshold")
+	}
+	b.Failure()
+	if b.Allow() {
+		t.Error("allowed a post after 2 consecutive failures")
+	}
+
+	now = now.Add(time.Minute)
+	if !b.Allow() {
+		t.Fatal("didn't half-open after the cool-down")
+	}
+	if b.Allow() {
+		t.Error("allowed a second post while the trial is in flight")
+	}
+	b.Failure()
+	if b.Allow() {
+		t.Error("a failed trial didn't open it again")
+	}
+
+	now = now.Add(time.Minute)
+	b.Allow()
+	b.Success()
+	if !b.Allow() || !b.Allow() {
+		t.Error("a successful trial didn't close it")
+	}
+}
+
+func TestDeduper(t *testing.T) {
+	now := time.Unix(0, 0)
+	d := newDeduper(10*time.Minute, []string{"range"})
+	d.now = func() time.Time { return now }
+	entry := zapcore.Entry{Level: zapcore.ErrorLevel, Message: "failed"}
+	week := []zapcore.Field{zap.String("range", "last_7_days"), zap.Int("attempt", 1)}
+
+	if post, _ := d.admit(entry, nil, week); !post {
+		t.Error("the first entry was suppressed")
+	}
+	// fields left out of the fingerprint don't make an entry unique
+	if post, _ := d.admit(entry, nil, []zapcore.Field{zap.String("range", "last_7_days"), zap.Int("attempt", 2)}); post {
+		t.Error("a repeat was posted")
+	}
+	if post, _ := d.admit(entry, nil, []zapcore.Field{zap.String("range", "last_year")}); !post {
+		t.Error("an entry for another range was suppressed")
+	}
+
+	now = now.Add(10 * time.Minute)
+	post, summary := d.admit(entry, nil, week)
+	if !post || summary == nil || summary.Message() != "failed (repeated 1 times in 10m)" {
+		t.Errorf("after the window admit() = %v, %+v", post, summary)
+	}
+	d.admit(entry, nil, week)
+	if summaries := d.flush(false); len(summaries) != 0 {
+		t.Errorf("flushed %d summaries before their window was over", len(summaries))
+	}
+	if summaries := d.flush(true); len(summaries) != 1 || summaries[0].repeated != 1 {
+		t.Errorf("flush(true) = %+v", summaries)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newTokenBucket(2, 1)
+	b.now = func() time.Time { return now }
+
+	waits := []time.Duration{b.reserve(), b.reserve(), b.reserve()}
+	want := []time.Duration{0, 500 * time.Millisecond, time.Second}
+	for i := range want {
+		if waits[i] != want[i] {
+			t.Errorf("reservation %d waits %v, want %v", i, waits[i], want[i])
+		}
+	}
+
+	now = now.Add(10 * time.Second)
+	if wait := b.reserve(); wait != 0 {
+		t.Errorf("a refilled bucket waits %v", wait)
+	}
+	b.Pause(3 * time.Second)
+	if wait := b.reserve(); wait != 3*time.Second {
+		t.Errorf("a paused bucket waits %v, want 3s", wait)
+	}
+}
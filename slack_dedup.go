@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// deduper suppresses repeats of an entry within a window of its first post and
+// counts them so a summary can be posted once the window is over. It is shared by
+// a SlackCore and its clones.
+type deduper struct {
+	window time.Duration
+	// fields whose values are part of the fingerprint besides the level and message
+	fields []string
+
+	lock sync.Mutex
+	seen map[uint64]*dedupRecord
+
+	now func() time.Time
+}
+
+type dedupRecord struct {
+	entry      zapcore.Entry
+	first      time.Time
+	suppressed int
+}
+
+// dedupSummary tells how often an entry was suppressed since first
+type dedupSummary struct {
+	entry    zapcore.Entry
+	repeated int
+	elapsed  time.Duration
+}
+
+func newDeduper(window time.Duration, fields []string) *deduper {
+	return &deduper{window: window, fields: fields, seen: map[uint64]*dedupRecord{}, now: time.Now}
+}
+
+// fingerprint identifies entries that are repeats of each other. Besides the level and message
+// every context field counts, so repeats logged through loggers of different ranges stay apart,
+// while of the entry's own fields only those picked by the deduper do.
+func (d *deduper) fingerprint(entry zapcore.Entry, context, fields []zapcore.Field) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d\x00%s", entry.Level, entry.Message)
+	enc := zapcore.NewMapObjectEncoder()
+	for _, field := range context {
+		field.AddTo(enc)
+	}
+	keys := make([]string, 0, len(enc.Fields))
+	for key := range enc.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(h, "\x00%s=%v", key, enc.Fields[key])
+	}
+	if len(d.fields) > 0 {
+		for _, field := range fields {
+			field.AddTo(enc)
+		}
+		for _, key := range d.fields {
+			fmt.Fprintf(h, "\x00%s=%v", key, enc.Fields[key])
+		}
+	}
+	return h.Sum64()
+}
+
+// admit reports whether entry, logged with context fields, should be posted, repeats within the
+// window are counted instead. When the entry's previous window ended with suppressed repeats their
+// summary is returned too.
+func (d *deduper) admit(entry zapcore.Entry, context, fields []zapcore.Field) (bool, *dedupSummary) {
+	if d == nil || d.window <= 0 {
+		return true, nil
+	}
+	key := d.fingerprint(entry, context, fields)
+	now := d.now()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	record, ok := d.seen[key]
+	if ok && now.Sub(record.first) < d.window {
+		record.suppressed++
+		return false, nil
+	}
+	var summary *dedupSummary
+	if ok && record.suppressed > 0 {
+		summary = record.summary(now)
+	}
+	d.seen[key] = &dedupRecord{entry: entry, first: now}
+	return true, summary
+}
+
+// flush forgets entries whose window is over, or every entry when all is set,
+// returning summaries of the ones that had repeats
+func (d *deduper) flush(all bool) []*dedupSummary {
+	if d == nil {
+		return nil
+	}
+	now := d.now()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var summaries []*dedupSummary
+	for key, record := range d.seen {
+		if !all && now.Sub(record.first) < d.window {
+			continue
+		}
+		if record.suppressed > 0 {
+			summaries = append(summaries, record.summary(now))
+		}
+		delete(d.seen, key)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].entry.Message < summaries[j].entry.Message })
+	return summaries
+}
+
+func (r *dedupRecord) summary(now time.Time) *dedupSummary {
+	return &dedupSummary{entry: r.entry, repeated: r.suppressed, elapsed: now.Sub(r.first)}
+}
+
+func (s *dedupSummary) Message() string {
+	return fmt.Sprintf("%s (repeated %d times in %s)", s.entry.Message, s.repeated, shortDuration(s.elapsed))
+}
+
+// shortDuration formats d to the second without trailing zero units, eg 10m rather than 10m0s
+func shortDuration(d time.Duration) string {
+	s := d.Round(time.Second).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker stops deliveries after threshold consecutive failures. Once cooldown
+// has passed a single trial delivery is let through, closing it again if that succeeds.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	lock     sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+
+	now func() time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// Allow reports whether a delivery may be attempted, the caller must report its outcome
+func (b *circuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// a trial is already in flight
+		return false
+	}
+	return true
+}
+
+func (b *circuitBreaker) Success() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.state, b.failures = breakerClosed, 0
+}
+
+func (b *circuitBreaker) Failure() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state, b.openedAt = breakerOpen, b.now()
+	}
+}
+
+// deadLetter spools messages that couldn't be delivered to a JSON lines file
+type deadLetter struct {
+	path string
+	lock sync.Mutex
+	// discarded is set once the file belongs to another instance
+	discarded bool
+}
+
+type deadLetterRecord struct {
+	Time    time.Time     `json:"time"`
+	Payload *slackMessage `json:"payload"`
+}
+
+// Append spools payload, each line is synced so it survives a crash
+func (d *deadLetter) Append(payload *slackMessage) error {
+	if d == nil || d.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(deadLetterRecord{Time: time.Now().UTC(), Payload: payload})
+	if err != nil {
+		return err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.discarded {
+		return nil
+	}
+	f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Discard drops whatever is appended from now on rather than writing it to the file
+func (d *deadLetter) Discard() {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.discarded = true
+}
+
+// Take empties the spool and returns what it held, unreadable lines are skipped
+func (d *deadLetter) Take() ([]*slackMessage, error) {
+	if d == nil || d.path == "" {
+		return nil, nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	f, err := os.Open(d.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var payloads []*slackMessage
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record deadLetterRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || record.Payload == nil {
+			logger.Warn("Skipping unreadable dead letter", zap.String("file", d.path), zap.Error(err))
+			continue
+		}
+		payloads = append(payloads, record.Payload)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return payloads, os.Truncate(d.path, 0)
+}
@@ -26,12 +26,33 @@ func getKVEncoder() *kvEncoder {
 func putKVEncoder(enc *kvEncoder) {
 	enc.EncoderConfig = nil
 	enc.buf = nil
+	enc.path = nil
+	enc.scopes = nil
+	enc.keys = 0
+	enc.keyed = false
 	_kvPool.Put(enc)
 }
 
 type kvEncoder struct {
 	*zapcore.EncoderConfig
 	buf *buffer.Buffer
+
+	// path holds the keys of the open objects and namespaces, keys below them are written as dotted paths
+	path []string
+	// scopes are the open arrays and the objects within them
+	scopes []kvScope
+	// keys counts the keys written outside any scope since the last element separator
+	keys int
+	// keyed is set between a key and its value so the value isn't taken for an array element
+	keyed bool
+}
+
+// kvScope is an array, whose elements are separated by commas, or an object within an array,
+// whose keys start over from the path saved here
+type kvScope struct {
+	array    bool
+	elements int
+	path     []string
 }
 
 // NewkvEncoder creates a key=value encoder
@@ -47,9 +68,19 @@ func (enc *kvEncoder) AddArray(key string, arr zapcore.ArrayMarshaler) error {
 	return enc.AppendArray(arr)
 }
 
+// AddObject writes the fields of obj with key prefixed to theirs, an empty object as key={}
 func (enc *kvEncoder) AddObject(key string, obj zapcore.ObjectMarshaler) error {
-	enc.addKey(key)
-	return enc.AppendObject(obj)
+	depth, cur := len(enc.path), enc.buf.Len()
+	enc.path = append(enc.path, key)
+	err := obj.MarshalLogObject(enc)
+	// namespaces opened by obj end with it
+	enc.path = enc.path[:depth]
+	if cur == enc.buf.Len() {
+		enc.addKey(key)
+		enc.keyed = false
+		enc.buf.AppendString("{}")
+	}
+	return err
 }
 
 func (enc *kvEncoder) AddBinary(key string, val []byte) {
@@ -92,11 +123,14 @@ func (enc *kvEncoder) AddReflected(key string, obj interface{}) error {
 		return err
 	}
 	enc.addKey(key)
+	enc.keyed = false
 	_, err = enc.buf.Write(marshaled)
 	return err
 }
 
+// OpenNamespace prefixes key to the keys that follow until the enclosing object ends
 func (enc *kvEncoder) OpenNamespace(key string) {
+	enc.path = append(enc.path, key)
 }
 
 func (enc *kvEncoder) AddString(key, val string) {
@@ -114,30 +148,52 @@ func (enc *kvEncoder) AddUint64(key string, val uint64) {
 	enc.AppendUint64(val)
 }
 
+// AppendArray writes arr as a bracketed list like [1,2,3]
 func (enc *kvEncoder) AppendArray(arr zapcore.ArrayMarshaler) error {
-	return arr.MarshalLogArray(enc)
+	enc.addElement()
+	enc.buf.AppendByte('[')
+	enc.scopes = append(enc.scopes, kvScope{array: true})
+	err := arr.MarshalLogArray(enc)
+	enc.scopes = enc.scopes[:len(enc.scopes)-1]
+	enc.buf.AppendByte(']')
+	return err
 }
 
+// AppendObject writes obj in braces like {name=alice age=30}, its keys don't carry the enclosing path
 func (enc *kvEncoder) AppendObject(obj zapcore.ObjectMarshaler) error {
-	return obj.MarshalLogObject(enc)
+	enc.addElement()
+	enc.buf.AppendByte('{')
+	enc.scopes = append(enc.scopes, kvScope{path: enc.path})
+	enc.path = nil
+	err := obj.MarshalLogObject(enc)
+	enc.path = enc.scopes[len(enc.scopes)-1].path
+	enc.scopes = enc.scopes[:len(enc.scopes)-1]
+	enc.buf.AppendByte('}')
+	return err
 }
 
 func (enc *kvEncoder) AppendBool(val bool) {
+	enc.addElement()
 	enc.buf.AppendBool(val)
 }
 
 func (enc *kvEncoder) AppendByteString(val []byte) {
+	enc.addElement()
 	enc.safeAddByteString(val)
 }
 
 func (enc *kvEncoder) AppendComplex128(val complex128) {
+	enc.addElement()
 	// Cast to a platform-independent, fixed-size type.
 	r, i := float64(real(val)), float64(imag(val))
 	enc.buf.AppendByte('"')
 	// Because we're always in a quoted string, we can use strconv without
 	// special-casing NaN and +/-Inf.
 	enc.buf.AppendFloat(r, 64)
-	enc.buf.AppendByte('+')
+	// AppendFloat already writes the sign of a negative imaginary part
+	if i >= 0 {
+		enc.buf.AppendByte('+')
+	}
 	enc.buf.AppendFloat(i, 64)
 	enc.buf.AppendByte('i')
 	enc.buf.AppendByte('"')
@@ -145,7 +201,9 @@ func (enc *kvEncoder) AppendComplex128(val complex128) {
 
 func (enc *kvEncoder) AppendDuration(val time.Duration) {
 	cur := enc.buf.Len()
-	enc.EncodeDuration(val, enc)
+	if enc.EncodeDuration != nil {
+		enc.EncodeDuration(val, enc)
+	}
 	if cur == enc.buf.Len() {
 		// User-supplied EncodeDuration is a no-op. Fall back to nanoseconds to keep
 		// JSON valid.
@@ -154,6 +212,7 @@ func (enc *kvEncoder) AppendDuration(val time.Duration) {
 }
 
 func (enc *kvEncoder) AppendInt64(val int64) {
+	enc.addElement()
 	enc.buf.AppendInt(val)
 }
 
@@ -162,17 +221,21 @@ func (enc *kvEncoder) AppendReflected(val interface{}) error {
 	if err != nil {
 		return err
 	}
+	enc.addElement()
 	_, err = enc.buf.Write(marshaled)
 	return err
 }
 
 func (enc *kvEncoder) AppendString(val string) {
+	enc.addElement()
 	enc.safeAddString(val)
 }
 
 func (enc *kvEncoder) AppendTime(val time.Time) {
 	cur := enc.buf.Len()
-	enc.EncodeTime(val, enc)
+	if enc.EncodeTime != nil {
+		enc.EncodeTime(val, enc)
+	}
 	if cur == enc.buf.Len() {
 		// User-supplied EncodeTime is a no-op. Fall back to nanos since epoch to keep
 		// output JSON valid.
@@ -181,6 +244,7 @@ func (enc *kvEncoder) AppendTime(val time.Time) {
 }
 
 func (enc *kvEncoder) AppendUint64(val uint64) {
+	enc.addElement()
 	enc.buf.AppendUint(val)
 }
 
@@ -211,13 +275,16 @@ func (enc *kvEncoder) AppendUintptr(v uintptr)            { enc.AppendUint64(uin
 func (enc *kvEncoder) Clone() zapcore.Encoder {
 	clone := enc.clone()
 	clone.buf.Write(enc.buf.Bytes())
+	clone.keys = enc.keys
 	return clone
 }
 
+// clone keeps the open namespaces so fields added after With stay in them
 func (enc *kvEncoder) clone() *kvEncoder {
 	clone := getKVEncoder()
 	clone.EncoderConfig = enc.EncoderConfig
 	clone.buf = bufferPool.Get()
+	clone.path = append([]string(nil), enc.path...)
 	return clone
 }
 
@@ -276,6 +343,7 @@ func (enc *kvEncoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field) (*b
 	}
 	if enc.buf.Len() > 0 {
 		final.buf.Write(enc.buf.Bytes())
+		final.addElementSeparator()
 	}
 	if len(fields) > 0 {
 		final.addElementTagSeparator()
@@ -283,6 +351,8 @@ func (enc *kvEncoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field) (*b
 	}
 	addFields(final, final, fields)
 	final.addElementSeparator()
+	// the stack isn't in any namespace the fields opened
+	final.path = nil
 	if ent.Stack != "" && final.StacktraceKey != "" {
 		final.AddString(final.StacktraceKey, ent.Stack)
 		final.addElementSeparator()
@@ -298,13 +368,45 @@ func (enc *kvEncoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field) (*b
 	return ret, nil
 }
 
+// addKey writes key below the open objects and namespaces, separated from the key before it
 func (enc *kvEncoder) addKey(key string) {
+	if n := len(enc.scopes); n > 0 {
+		if enc.scopes[n-1].elements > 0 {
+			enc.buf.AppendByte(' ')
+		}
+		enc.scopes[n-1].elements++
+	} else {
+		if enc.keys > 0 {
+			enc.buf.AppendByte(' ')
+		}
+		enc.keys++
+	}
+	for _, name := range enc.path {
+		enc.buf.AppendString(name)
+		enc.buf.AppendByte('.')
+	}
 	enc.buf.AppendString(key)
 	enc.buf.AppendByte('=')
+	enc.keyed = true
+}
+
+// addElement separates the elements of an array, a value following its key needs no separator
+func (enc *kvEncoder) addElement() {
+	if enc.keyed {
+		enc.keyed = false
+		return
+	}
+	if n := len(enc.scopes); n > 0 && enc.scopes[n-1].array {
+		if enc.scopes[n-1].elements > 0 {
+			enc.buf.AppendByte(',')
+		}
+		enc.scopes[n-1].elements++
+	}
 }
 
 func (enc *kvEncoder) addElementSeparator() {
 	enc.buf.AppendByte(' ')
+	enc.keys = 0
 }
 
 func (env *kvEncoder) addElementTagSeparator() {
@@ -312,6 +414,7 @@ func (env *kvEncoder) addElementTagSeparator() {
 }
 
 func (enc *kvEncoder) appendFloat(val float64, bitSize int) {
+	enc.addElement()
 	switch {
 	case math.IsNaN(val):
 		enc.buf.AppendString(`"NaN"`)
@@ -401,7 +504,11 @@ func (enc *kvEncoder) tryAddRuneError(r rune, size int) bool {
 
 func addFields(kvEnc *kvEncoder, enc zapcore.ObjectEncoder, fields []zapcore.Field) {
 	for i := range fields {
+		cur := kvEnc.buf.Len()
 		fields[i].AddTo(enc)
-		kvEnc.buf.AppendByte(' ')
+		// namespaces and skipped fields write nothing
+		if kvEnc.buf.Len() != cur {
+			kvEnc.addElementSeparator()
+		}
 	}
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var kvTestConfig = zapcore.EncoderConfig{
+	MessageKey:     "msg",
+	EncodeTime:     zapcore.ISO8601TimeEncoder,
+	EncodeDuration: zapcore.StringDurationEncoder,
+}
+
+// encodeKVFields returns how the kv encoder renders fields, without the message in front
+func encodeKVFields(t *testing.T, cfg zapcore.EncoderConfig, fields ...zapcore.Field) string {
+	buf, err := NewKVEncoder(cfg).EncodeEntry(zapcore.Entry{Message: "msg"}, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buf.Free()
+	return strings.TrimSpace(strings.TrimPrefix(buf.String(), "msg | "))
+}
+
+type kvTestUser struct {
+	name string
+	age  int
+}
+
+func (u kvTestUser) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("name", u.name)
+	enc.AddInt("age", u.age)
+	return nil
+}
+
+func TestKVEncoder_FieldTypes(t *testing.T) {
+	at := time.Date(2019, 1, 2, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		field zapcore.Field
+		want  string
+	}{
+		{"array", zap.Ints("ids", []int{1, 2, 3}), "ids=[1,2,3]"},
+		{"string array", zap.Strings("tags", []string{"a", "b"}), "tags=[a,b]"},
+		{"empty array", zap.Strings("tags", nil), "tags=[]"},
+		{"object", zap.Object("user", kvTestUser{"alice", 30}), "user.name=alice user.age=30"},
+		{"binary", zap.Binary("raw", []byte("hi")), "raw=aGk="},
+		{"bool", zap.Bool("ok", true), "ok=true"},
+		{"byte string", zap.ByteString("body", []byte(`{"a":1}`)), `body={\"a\":1}`},
+		{"complex128", zap.Complex128("c", 1+2i), `c="1+2i"`},
+		{"complex64", zap.Complex64("c", 1.5+2i), `c="1.5+2i"`},
+		{"negative imaginary", zap.Complex64("c", 1.5-2i), `c="1.5-2i"`},
+		{"duration", zap.Duration("took", 1500*time.Millisecond), "took=1.5s"},
+		{"float64", zap.Float64("ratio", 0.125), "ratio=0.125"},
+		{"float64 nan", zap.Float64("ratio", math.NaN()), `ratio="NaN"`},
+		{"float32", zap.Float32("ratio", 0.25), "ratio=0.25"},
+		{"int64", zap.Int64("n", -64), "n=-64"},
+		{"int32", zap.Int32("n", -32), "n=-32"},
+		{"int16", zap.Int16("n", -16), "n=-16"},
+		{"int8", zap.Int8("n", -8), "n=-8"},
+		{"string", zap.String("s", `say "hi"`), `s=say \"hi\"`},
+		{"time", zap.Time("at", at), "at=2019-01-02T12:00:00.000Z"},
+		{"uint64", zap.Uint64("n", 64), "n=64"},
+		{"uint32", zap.Uint32("n", 32), "n=32"},
+		{"uint16", zap.Uint16("n", 16), "n=16"},
+		{"uint8", zap.Uint8("n", 8), "n=8"},
+		{"uintptr", zap.Uintptr("p", 0xff), "p=255"},
+		{"reflect", zap.Reflect("r", map[string]int{"a": 1}), `r={"a":1}`},
+		{"namespace", zap.Namespace("http"), ""},
+		{"stringer", zap.Stringer("level", zapcore.WarnLevel), "level=warn"},
+		{"error", zap.Error(errors.New("boom")), "error=boom"},
+		{"skip", zap.Skip(), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encodeKVFields(t, kvTestConfig, tt.field); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKVEncoder_Nesting(t *testing.T) {
+	request := zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+		enc.AddString("method", "GET")
+		enc.AddObject("url", zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+			enc.AddString("host", "wakatime.com")
+			enc.AddString("path", "/api")
+			return nil
+		}))
+		enc.AddArray("retries", zapcore.ArrayMarshalerFunc(func(enc zapcore.ArrayEncoder) error {
+			enc.AppendDuration(time.Second)
+			enc.AppendDuration(2 * time.Second)
+			return nil
+		}))
+		return nil
+	})
+	namespaced := zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+		enc.AddInt("status", 429)
+		enc.OpenNamespace("headers")
+		enc.AddString("retry", "5")
+		return nil
+	})
+	users := zapcore.ArrayMarshalerFunc(func(enc zapcore.ArrayEncoder) error {
+		enc.AppendObject(kvTestUser{"alice", 30})
+		enc.AppendObject(kvTestUser{"bob", 25})
+		return nil
+	})
+	matrix := zapcore.ArrayMarshalerFunc(func(enc zapcore.ArrayEncoder) error {
+		enc.AppendArray(zapcore.ArrayMarshalerFunc(func(enc zapcore.ArrayEncoder) error {
+			enc.AppendInt(1)
+			enc.AppendInt(2)
+			return nil
+		}))
+		enc.AppendArray(zapcore.ArrayMarshalerFunc(func(enc zapcore.ArrayEncoder) error {
+			enc.AppendString("x")
+			return nil
+		}))
+		return nil
+	})
+	tests := []struct {
+		name   string
+		fields []zapcore.Field
+		want   string
+	}{
+		{
+			name:   "nested objects",
+			fields: []zapcore.Field{zap.Object("req", request), zap.Int("attempt", 2)},
+			want:   "req.method=GET req.url.host=wakatime.com req.url.path=/api req.retries=[1s,2s] attempt=2",
+		},
+		{
+			name:   "namespace",
+			fields: []zapcore.Field{zap.String("user", "alice"), zap.Namespace("http"), zap.Int("status", 429), zap.Object("req", request)},
+			want:   "user=alice http.status=429 http.req.method=GET http.req.url.host=wakatime.com http.req.url.path=/api http.req.retries=[1s,2s]",
+		},
+		{
+			name:   "namespace ends with its object",
+			fields: []zapcore.Field{zap.Object("resp", namespaced), zap.String("user", "alice")},
+			want:   "resp.status=429 resp.headers.retry=5 user=alice",
+		},
+		{
+			name:   "objects in an array",
+			fields: []zapcore.Field{zap.Namespace("batch"), zap.Array("users", users)},
+			want:   "batch.users=[{name=alice age=30},{name=bob age=25}]",
+		},
+		{
+			name:   "arrays in an array",
+			fields: []zapcore.Field{zap.Array("matrix", matrix)},
+			want:   "matrix=[[1,2],[x]]",
+		},
+		{
+			name:   "empty object",
+			fields: []zapcore.Field{zap.Object("empty", zapcore.ObjectMarshalerFunc(func(zapcore.ObjectEncoder) error { return nil }))},
+			want:   "empty={}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encodeKVFields(t, kvTestConfig, tt.fields...); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKVEncoder_WithNamespace(t *testing.T) {
+	var out bytes.Buffer
+	core := zapcore.NewCore(NewKVEncoder(kvTestConfig), zapcore.AddSync(&out), zapcore.DebugLevel)
+	log := zap.New(core).With(zap.String("run", "7"), zap.Namespace("http"), zap.Int("attempt", 1))
+
+	log.Warn("rate limited", zap.Int("status", 429))
+
+	if got, want := strings.TrimSpace(out.String()), "rate limited run=7 http.attempt=1 | http.status=429"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestKVEncoder_WithoutTimeAndDurationEncoders(t *testing.T) {
+	at := time.Unix(0, 1546430400000000000)
+	got := encodeKVFields(t, zapcore.EncoderConfig{MessageKey: "msg"}, zap.Time("at", at), zap.Duration("took", time.Millisecond))
+	if want := "at=1546430400000000000 took=1000000"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"go.uber.org/zap"
+)
+
+const (
+	slackAPIURL = "https://slack.com/api/"
+	// slackProgressInterval is how often the parent message of a run's thread is updated
+	slackProgressInterval = 30 * time.Second
+)
+
+// slackThread is the parent message a run's alerts are posted below, shared by a SlackCore and its clones
+type slackThread struct {
+	lock sync.Mutex
+	// channel is the ID Slack answered with, updating a message needs it rather than a name
+	channel string
+	ts      string
+	text    string
+	updated time.Time
+	// next is the latest update not posted yet, updates of the parent message are
+	// posted from a goroutine of their own and replace each other while it is busy.
+	// idle is broadcast once it is done.
+	next     *slackMessage
+	updating bool
+	idle     *sync.Cond
+
+	now func() time.Time
+}
+
+func newSlackThread() *slackThread {
+	t := &slackThread{now: time.Now}
+	t.idle = sync.NewCond(&t.lock)
+	return t
+}
+
+// waitUpdates returns once the updates of the parent message were posted
+func (t *slackThread) waitUpdates() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for t.updating {
+		t.idle.Wait()
+	}
+}
+
+// TS is the timestamp of the parent message, empty until a thread was started
+func (t *slackThread) TS() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.ts
+}
+
+// slackAPIResponse holds the parts of a Web API answer the collector cares about
+type slackAPIResponse struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Channel string `json:"channel"`
+	TS      string `json:"ts"`
+}
+
+// StartThread posts text as the parent message every following alert replies to.
+// It needs a bot token, with only a webhook alerts stay standalone posts.
+func (sh *SlackCore) StartThread(text string) error {
+	if sh == nil || sh.Token == "" {
+		return nil
+	}
+	var resp *slackAPIResponse
+	err := sh.rateLimited(func(client *http.Client) (err error) {
+		resp, err = callSlackAPI(client, sh.APIURL+"chat.postMessage", sh.Token, &slackMessage{Channel: sh.Channel, Text: text})
+		return err
+	})
+	if err != nil {
+		return errorx.Decorate(err, "failed to start slack thread")
+	}
+	t := sh.thread
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.channel, t.ts, t.text, t.updated = resp.Channel, resp.TS, text, t.now()
+	return nil
+}
+
+// UpdateThread replaces the text of the parent message, at most once per slackProgressInterval
+// unless final is set. The update is posted in the background, only the latest one is
+// posted when several pile up while Slack is slow.
+func (sh *SlackCore) UpdateThread(text string, final bool) {
+	if sh == nil || sh.Token == "" {
+		return
+	}
+	t := sh.thread
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := t.now()
+	if t.ts == "" || text == t.text || (!final && now.Sub(t.updated) < slackProgressInterval) {
+		return
+	}
+	t.text, t.updated = text, now
+	t.next = &slackMessage{Channel: t.channel, TS: t.ts, Text: text}
+	if t.updating {
+		return
+	}
+	t.updating = true
+	go sh.postUpdates()
+}
+
+// postUpdates posts the latest update of the parent message until none is left
+func (sh *SlackCore) postUpdates() {
+	t := sh.thread
+	for {
+		t.lock.Lock()
+		update := t.next
+		t.next = nil
+		if update == nil {
+			t.updating = false
+			t.idle.Broadcast()
+			t.lock.Unlock()
+			return
+		}
+		t.lock.Unlock()
+
+		err := sh.rateLimited(func(client *http.Client) error {
+			_, err := callSlackAPI(client, sh.APIURL+"chat.update", sh.Token, update)
+			return err
+		})
+		if err != nil {
+			logger.Warn("Failed to update slack thread", zap.Error(err))
+		}
+	}
+}
+
+// NotifyRun posts summary once the queued alerts and thread updates were, in the run's thread when there is one
+func (sh *SlackCore) NotifyRun(summary *RunSummary) error {
+	sh.queue.wait()
+	sh.thread.waitUpdates()
+	return sh.send(createSummaryPayload(summary))
+}
+
+// callSlackAPI posts payload to a Web API method. Slack answers errors with a 200 and ok set
+// to false, those that retrying won't fix are returned as NotifyRejected.
+func callSlackAPI(client *http.Client, url, token string, payload *slackMessage) (*slackAPIResponse, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errorx.Decorate(err, "marshal failed")
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(raw))
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to create request")
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, NotifyPostFailed.Wrap(err, "failed to call %s", url)
+	}
+	defer resp.Body.Close()
+	if err := statusError(resp); err != nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, err
+	}
+	var answer slackAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, NotifyPostFailed.Wrap(err, "unreadable answer from %s", url)
+	}
+	if !answer.OK {
+		switch answer.Error {
+		case "internal_error", "fatal_error", "service_unavailable", "request_timeout":
+			return nil, NotifyPostFailed.New(answer.Error)
+		}
+		return nil, NotifyRejected.New(answer.Error)
+	}
+	return &answer, nil
+}
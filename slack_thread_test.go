@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"go.uber.org/zap/zapcore"
+)
+
+// newSlackAPIServer answers chat.postMessage and chat.update like the Web API,
+// chat.update calls are held up until block is closed unless it is nil
+func newSlackAPIServer(block chan struct{}) *recordingServer {
+	s := newRecordingServer()
+	s.reply = func(w http.ResponseWriter, r *http.Request, n int) {
+		if r.Header.Get("Authorization") != "Bearer xoxb-test" {
+			json.NewEncoder(w).Encode(slackAPIResponse{Error: "invalid_auth"})
+			return
+		}
+		if block != nil && r.URL.Path == "/chat.update" {
+			<-block
+		}
+		json.NewEncoder(w).Encode(slackAPIResponse{OK: true, Channel: "C0123", TS: fmt.Sprintf("1500000000.%06d", n)})
+	}
+	return s
+}
+
+func TestSlackCore_ThreadsRunAlerts(t *testing.T) {
+	server := newSlackAPIServer(nil)
+	defer server.Close()
+	core := newTestSlackCore("")
+	core.Token, core.Channel, core.APIURL = "xoxb-test", "#wakatime", server.URL+"/"
+	now := time.Unix(0, 0)
+	core.thread.now = func() time.Time { return now }
+
+	if err := core.StartThread("Run started: last_7_days"); err != nil {
+		t.Fatal(err)
+	}
+	core.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "stats request failed"}, nil)
+	core.Sync()
+	// progress is only shown once the interval has passed, the end of a run always is
+	core.UpdateThread("Run in progress: last_7_days, 1 of 10 users collected", false)
+	now = now.Add(slackProgressInterval)
+	core.UpdateThread("Run in progress: last_7_days, 5 of 10 users collected", false)
+	core.Sync()
+	core.UpdateThread("Run finished: last_7_days, 10 of 10 users collected", true)
+	core.Sync()
+
+	requests, calls := server.Requests(), server.Posts()
+	if len(calls) != 4 {
+		t.Fatalf("made %d calls, want 4: %+v", len(calls), calls)
+	}
+	parent := calls[0]
+	if requests[0].Path != "chat.postMessage" || parent.Channel != "#wakatime" || parent.ThreadTS != "" {
+		t.Errorf("parent posted as %+v", parent)
+	}
+	reply := calls[1]
+	if requests[1].Path != "chat.postMessage" || reply.ThreadTS != "1500000000.000001" || reply.Channel != "#wakatime" {
+		t.Errorf("alert posted as %+v, want a reply to the parent", reply)
+	}
+	for i, want := range []string{"5 of 10", "10 of 10"} {
+		update := calls[2+i]
+		if requests[2+i].Path != "chat.update" || update.Channel != "C0123" || update.TS != "1500000000.000001" || !strings.Contains(update.Text, want) {
+			t.Errorf("update %d is %+v, want %s users collected", i, update, want)
+		}
+	}
+}
+
+func TestSlackCore_CoalescesThreadUpdates(t *testing.T) {
+	block := make(chan struct{})
+	server := newSlackAPIServer(block)
+	defer server.Close()
+	core := newTestSlackCore("")
+	core.Token, core.Channel, core.APIURL = "xoxb-test", "#wakatime", server.URL+"/"
+	if err := core.StartThread("Run started: last_7_days"); err != nil {
+		t.Fatal(err)
+	}
+
+	// none of these wait for slack, the first is posted while the others replace each other
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 3; i++ {
+			core.UpdateThread(fmt.Sprintf("Run in progress: last_7_days, %d of 3 users collected", i), true)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("UpdateThread waited for slack")
+	}
+	close(block)
+	core.Sync()
+
+	var texts []string
+	for _, update := range server.Posts()[1:] {
+		texts = append(texts, update.Text)
+	}
+	// the first update may have been taken before the others arrived or not
+	if last := texts[len(texts)-1]; len(texts) > 2 || !strings.Contains(last, "3 of 3") {
+		t.Errorf("updated the thread with %q, want the last update posted and the middle one dropped", texts)
+	}
+}
+
+func TestSlackCore_ThreadNeedsToken(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+	core := newTestSlackCore(server.URL)
+
+	if err := core.StartThread("Run started"); err != nil {
+		t.Fatal(err)
+	}
+	core.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "failed"}, nil)
+	core.Sync()
+	if posts := server.Posts(); len(posts) != 1 || posts[0].ThreadTS != "" {
+		t.Errorf("posted %+v through the webhook, want one standalone post", posts)
+	}
+
+	var nilCore *SlackCore
+	if nilCore.StartThread("Run started") != nil {
+		t.Error("a missing slack core failed to thread")
+	}
+	nilCore.UpdateThread("Run finished", true)
+}
+
+func TestCallSlackAPI_Errors(t *testing.T) {
+	server := newSlackAPIServer(nil)
+	defer server.Close()
+	_, err := callSlackAPI(http.DefaultClient, server.URL+"/chat.postMessage", "xoxb-wrong", &slackMessage{Text: "hi"})
+	if !strings.Contains(fmt.Sprint(err), "invalid_auth") || !errorx.IsOfType(err, NotifyRejected) {
+		t.Errorf("a bad token returned %v, want it rejected", err)
+	}
+}
@@ -3,47 +3,18 @@ package main
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"io"
-	"io/ioutil"
 	"os"
-	"path"
-	"strings"
 	"sync"
 	"time"
-)
 
-var lock sync.Mutex
+	"go.uber.org/zap"
+)
 
 type marshaller func(v interface{}) (io.Reader, error)
 type unmarshaller func(r io.Reader, v interface{}) error
 
-// Load loads the file at path into v.
-// Use os.IsNotExist() to see if the returned error is due
-// to the file being missing.
-func Load(path string, v interface{}, unmarshal unmarshaller) (rerr error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err := f.Close()
-		if err != nil {
-			rerr = err
-		}
-	}()
-	return unmarshal(f, v)
-}
-
-// Save saves a representation of v to the file at path.
-func Save(f *os.File, v interface{}, marshal marshaller) (rerr error) {
-	r, err := marshal(v)
-	if err != nil {
-		return err
-	}
-	_, err = io.Copy(f, r)
-	return err
-}
-
 func GlobEncoder(v interface{}) (io.Reader, error) {
 	b := new(bytes.Buffer)
 
@@ -66,120 +37,245 @@ func GlobDecoder(r io.Reader, v interface{}) error {
 	return nil
 }
 
-func targetPathExists(path string) (bool, error) {
-	_, err := os.Stat(path)
-	if err == nil {
-		return true, nil
+// PersistentMap is a map mirrored to a snapshot file. All access goes
+// through its methods which handle locking. Every change is appended to a journal
+// next to the snapshot, which is replayed on Read and compacted into the snapshot
+// once it grows large, so progress survives a crash without rewriting the whole map.
+type PersistentMap[K comparable, V any] struct {
+	file    string
+	kind    string
+	items   map[K]V
+	dirty   bool
+	lock    sync.RWMutex
+	journal *Journal[K, V]
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// NewPersistentMap returns an empty map backed by file holding the state kind,
+// call Read to load it. Without a file the map is only kept in memory.
+func NewPersistentMap[K comparable, V any](file, kind string, capacity int) *PersistentMap[K, V] {
+	m := &PersistentMap[K, V]{
+		file:  file,
+		kind:  kind,
+		items: make(map[K]V, capacity),
 	}
-	if os.IsNotExist(err) {
-		return false, nil
+	if file != "" {
+		m.journal = NewJournal[K, V](file+".journal", journalBatchSize)
 	}
-	return false, err
+	return m
 }
 
-type DiskMappedObject struct {
-	mapped interface{}
-	file   string
-	quit   chan struct{}
-	lock   sync.RWMutex
+func (m *PersistentMap[K, V]) Get(key K) (V, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	v, ok := m.items[key]
+	return v, ok
 }
 
-func (m *DiskMappedObject) Sync() {
-	// logger.Debug("Syncing")
-	err := m.Write(false)
-	if err != nil {
-		logger.Fatal(err.Error())
+func (m *PersistentMap[K, V]) Set(key K, value V) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.items[key] = value
+	m.dirty = true
+	m.appendJournal(key, value)
+}
+
+// appendJournal records a change, the caller must hold the write lock
+func (m *PersistentMap[K, V]) appendJournal(key K, value V) {
+	if m.journal == nil {
+		return
+	}
+	if err := m.journal.Append(key, value); err != nil {
+		logger.Error("Failed to journal change to "+m.file, zap.Error(err))
 	}
 }
 
-func (m *DiskMappedObject) ForceSync() {
-	// logger.Debug("Syncing")
-	err := m.Write(true)
-	if err != nil {
-		logger.Fatal(err.Error())
+// Update calls fn with the current value of key under the write lock.
+// The returned value is stored only if fn also returns true.
+func (m *PersistentMap[K, V]) Update(key K, fn func(value V, ok bool) (V, bool)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	old, ok := m.items[key]
+	if value, store := fn(old, ok); store {
+		m.items[key] = value
+		m.dirty = true
+		m.appendJournal(key, value)
 	}
 }
 
-func (m *DiskMappedObject) Read() {
-	if _, err := os.Stat(m.file); err == nil {
-		if err := Load(m.file, m.mapped, GlobDecoder); err != nil {
-			logger.Panic(err.Error())
+// SetMissing stores value for the keys not in the map yet. A bulk load like this goes
+// straight into a new snapshot instead of the journal.
+func (m *PersistentMap[K, V]) SetMissing(keys []K, value V) error {
+	m.lock.Lock()
+	added := 0
+	for _, key := range keys {
+		if _, ok := m.items[key]; !ok {
+			m.items[key] = value
+			added++
 		}
 	}
+	if added > 0 {
+		m.dirty = true
+	}
+	m.lock.Unlock()
+	if added == 0 {
+		return nil
+	}
+	return m.Write()
 }
 
-func (m *DiskMappedObject) Write(force bool) (rerr error) {
-	var err error
-	tmpfile, err := ioutil.TempFile("", path.Base(m.file))
-	if err != nil {
-		return err
+// Range calls fn for every entry until it returns false. fn is called on a
+// snapshot without holding the lock so it may take its time and modify the map.
+func (m *PersistentMap[K, V]) Range(fn func(key K, value V) bool) {
+	m.lock.RLock()
+	snapshot := make(map[K]V, len(m.items))
+	for key, value := range m.items {
+		snapshot[key] = value
 	}
-	defer func() {
-		err := tmpfile.Close()
-		if err != nil {
-			rerr = err
+	m.lock.RUnlock()
+	for key, value := range snapshot {
+		if !fn(key, value) {
+			return
 		}
-	}()
-	if !force {
-		m.lock.RLock()
-		err = Save(tmpfile, m.mapped, GlobEncoder)
-		m.lock.RUnlock()
-	} else {
-		err = Save(tmpfile, m.mapped, GlobEncoder)
 	}
-	if err != nil {
+}
+
+// Keys returns a snapshot of the keys in the map
+func (m *PersistentMap[K, V]) Keys() []K {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	keys := make([]K, 0, len(m.items))
+	for key := range m.items {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (m *PersistentMap[K, V]) Len() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return len(m.items)
+}
+
+// Read merges the snapshot and then the journal into the map, missing files are not an error
+func (m *PersistentMap[K, V]) Read() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, err := LoadState(m.file, m.kind, &m.items)
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	if m.journal == nil {
+		return nil
+	}
+	applied, err := m.journal.Replay(func(key K, value V) {
+		m.items[key] = value
+	})
+	if applied > 0 {
+		// the replayed changes are not in the snapshot yet
+		m.dirty = true
+	}
+	return err
+}
 
-	if found, err := targetPathExists(m.file); !found && err == nil {
-		f, err := os.Create(m.file)
-		if err != nil {
-			return err
-		}
-		f.Close()
+// Write saves a snapshot of the map regardless of whether it changed and compacts the journal
+func (m *PersistentMap[K, V]) Write() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.file == "" {
+		m.dirty = false
+		return nil
 	}
-	err = os.Rename(tmpfile.Name(), m.file)
+	err := writeAtomically(m.file, func(w io.Writer) error {
+		return SaveState(w, m.kind, m.items, CodecForPath(m.file))
+	})
 	if err != nil {
-		if strings.Contains(err.Error(), "invalid cross-device") {
-			defer os.Remove(tmpfile.Name())
-			f, err := os.Create(m.file)
-			if err != nil {
-				return err
-			}
-			tmpfile.Sync()
-			tmpfile.Seek(0, 0)
-			_, err = io.Copy(f, tmpfile)
-			if err != nil {
-				return err
-			}
-			err = f.Sync()
-			if err != nil {
-				return err
-			}
-			err = f.Close()
-			return err
-		}
 		return err
 	}
+	m.dirty = false
+	if m.journal != nil {
+		return m.journal.Truncate()
+	}
 	return nil
 }
 
-func (m *DiskMappedObject) PeriodicWrite(duration time.Duration) error {
-	ticker := time.NewTicker(duration)
-	m.quit = make(chan struct{})
+// Sync saves the map if it changed since the last write
+func (m *PersistentMap[K, V]) Sync() error {
+	m.lock.RLock()
+	dirty := m.dirty
+	m.lock.RUnlock()
+	if !dirty {
+		return nil
+	}
+	return m.Write()
+}
+
+// compact writes a snapshot once the journal grew past journalCompactSize
+func (m *PersistentMap[K, V]) compact() error {
+	if m.journal == nil {
+		return m.Sync()
+	}
+	size, err := m.journal.Size()
+	if err != nil || size < journalCompactSize {
+		return err
+	}
+	return m.Write()
+}
+
+// PeriodicWrite flushes the journal every journalFlushInterval and checks every
+// duration whether it is large enough to compact, until Close is called
+func (m *PersistentMap[K, V]) PeriodicWrite(duration time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.quit != nil {
+		return errors.New("periodic write already started")
+	}
+	quit, done := make(chan struct{}), make(chan struct{})
+	m.quit, m.done = quit, done
 	go func() {
+		defer close(done)
+		ticker := time.NewTicker(duration)
+		defer ticker.Stop()
+		flush := time.NewTicker(journalFlushInterval)
+		defer flush.Stop()
 		for {
 			select {
+			case <-flush.C:
+				if m.journal == nil {
+					continue
+				}
+				if err := m.journal.Flush(); err != nil {
+					logger.Error("Failed to flush journal of "+m.file, zap.Error(err))
+				}
 			case <-ticker.C:
-				err := m.Write(false)
-				if err != nil {
-					logger.Fatal(err.Error())
+				if err := m.compact(); err != nil {
+					logger.Error("Failed to compact "+m.file, zap.Error(err))
 				}
-			case <-m.quit:
-				ticker.Stop()
+			case <-quit:
 				return
 			}
 		}
 	}()
 	return nil
 }
+
+// Close stops PeriodicWrite and writes a final snapshot of any pending changes
+func (m *PersistentMap[K, V]) Close() error {
+	m.lock.Lock()
+	quit, done := m.quit, m.done
+	m.quit, m.done = nil, nil
+	m.lock.Unlock()
+	if quit != nil {
+		close(quit)
+		<-done
+	}
+	if err := m.Sync(); err != nil {
+		return err
+	}
+	if m.journal != nil {
+		return m.journal.Close()
+	}
+	return nil
+}
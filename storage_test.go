@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPersistentMap_Methods(t *testing.T) {
+	m := NewPersistentMap[string, int]("", "", 0)
+	m.Set("a", 1)
+	m.Update("a", func(v int, ok bool) (int, bool) { return v + 1, ok })
+	m.Update("b", func(v int, ok bool) (int, bool) { return 10, !ok })
+	m.Update("b", func(v int, ok bool) (int, bool) { return 20, !ok })
+
+	if v, ok := m.Get("a"); !ok || v != 2 {
+		t.Errorf("Get(a) = %d, %v; want 2, true", v, ok)
+	}
+	if v, _ := m.Get("b"); v != 10 {
+		t.Errorf("Get(b) = %d, want 10", v)
+	}
+	if _, ok := m.Get("c"); ok {
+		t.Error("Get(c) found a missing key")
+	}
+	if m.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", m.Len())
+	}
+
+	sum := 0
+	m.Range(func(key string, value int) bool {
+		// modifying the map while ranging must not deadlock
+		m.Set(key+key, value)
+		sum += value
+		return true
+	})
+	if sum != 12 || m.Len() != 4 {
+		t.Errorf("Range() sum = %d, Len() = %d; want 12, 4", sum, m.Len())
+	}
+}
+
+func TestPersistentMap_InMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persistent-map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	m := NewPersistentMap[string, bool]("", usersStateKind, 0)
+	m.Set("a", true)
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close() of an in-memory map error = %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("an in-memory map wrote %d files", len(files))
+	}
+}
+
+func TestPersistentMap_Persistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persistent-map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "users.tmp")
+
+	m := NewPersistentMap[string, bool](file, usersStateKind, 0)
+	if err := m.Read(); err != nil {
+		t.Fatalf("Read() of a missing file error = %v", err)
+	}
+	if err := m.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatal("Sync() wrote an unchanged map")
+	}
+
+	if err := m.PeriodicWrite(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	m.Set("a", true)
+	m.Set("b", false)
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := NewPersistentMap[string, bool](file, usersStateKind, 0)
+	reloaded.Set("c", false)
+	reloaded.Set("a", false)
+	if err := reloaded.Read(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := reloaded.Get("a"); !v || reloaded.Len() != 3 {
+		t.Errorf("Read() did not merge the saved map, a = %v, Len() = %d", v, reloaded.Len())
+	}
+}
+
+func TestPersistentMap_CompactsLargeJournals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persistent-map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "users.tmp")
+
+	m := NewPersistentMap[string, bool](file, usersStateKind, 0)
+	m.Set("a", true)
+	if err := m.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatal("compact() wrote a snapshot for a small journal")
+	}
+
+	for i := 0; int64(i)*32 < journalCompactSize; i++ {
+		m.Set(strconv.Itoa(i), false)
+	}
+	if err := m.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("compact() didn't write a snapshot for a large journal: %v", err)
+	}
+	if size, _ := m.journal.Size(); size != 0 {
+		t.Errorf("journal size = %d after compacting, want 0", size)
+	}
+}
+
+func TestPersistentMap_SetMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persistent-map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "users.tmp")
+
+	m := NewPersistentMap[string, bool](file, usersStateKind, 0)
+	m.Set("a", true)
+	if err := m.SetMissing([]string{"a", "b", "c"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m.Get("a"); !v || m.Len() != 3 {
+		t.Errorf("a = %v, Len() = %d, want a kept and b, c added", v, m.Len())
+	}
+	if size, _ := m.journal.Size(); size != 0 {
+		t.Errorf("journal size = %d, want the bulk load in the snapshot", size)
+	}
+
+	reloaded := NewPersistentMap[string, bool](file, usersStateKind, 0)
+	if err := reloaded.Read(); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Len() != 3 {
+		t.Errorf("reloaded Len() = %d, want 3", reloaded.Len())
+	}
+}
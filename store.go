@@ -0,0 +1,351 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/go-openapi/strfmt"
+	"github.com/joomcode/errorx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/will7200/go-wakatime/models"
+)
+
+// storeMigrations are applied in order, PRAGMA user_version records how many ran
+var storeMigrations = []string{
+	`CREATE TABLE runs (
+		id               INTEGER PRIMARY KEY,
+		range_name       TEXT NOT NULL,
+		started_at       TIMESTAMP NOT NULL,
+		finished_at      TIMESTAMP,
+		result           TEXT,
+		error            TEXT,
+		version          TEXT,
+		users_discovered INTEGER,
+		users_collected  INTEGER
+	);
+	CREATE TABLE users (
+		id           TEXT PRIMARY KEY,
+		username     TEXT,
+		display_name TEXT,
+		full_name    TEXT,
+		location     TEXT,
+		website      TEXT,
+		first_seen   TIMESTAMP NOT NULL,
+		last_seen    TIMESTAMP NOT NULL
+	);
+	CREATE TABLE leaderboard_snapshots (
+		run_id        INTEGER NOT NULL REFERENCES runs(id),
+		range_name    TEXT NOT NULL,
+		page          INTEGER NOT NULL,
+		rank          INTEGER NOT NULL,
+		user_id       TEXT NOT NULL REFERENCES users(id),
+		total_seconds REAL,
+		daily_average INTEGER,
+		PRIMARY KEY (run_id, rank)
+	);
+	CREATE TABLE user_stats (
+		run_id                  INTEGER NOT NULL REFERENCES runs(id),
+		user_id                 TEXT NOT NULL REFERENCES users(id),
+		range_name              TEXT,
+		range_start             TIMESTAMP,
+		range_end               TIMESTAMP,
+		timezone                TEXT,
+		total_seconds           REAL,
+		daily_average           INTEGER,
+		days_including_holidays INTEGER,
+		status                  TEXT,
+		collected_at            TIMESTAMP NOT NULL,
+		PRIMARY KEY (run_id, user_id)
+	);
+	CREATE TABLE stat_breakdowns (
+		run_id        INTEGER NOT NULL,
+		user_id       TEXT NOT NULL,
+		category      TEXT NOT NULL,
+		name          TEXT NOT NULL,
+		total_seconds REAL,
+		percent       REAL,
+		PRIMARY KEY (run_id, user_id, category, name),
+		FOREIGN KEY (run_id, user_id) REFERENCES user_stats(run_id, user_id)
+	);
+	CREATE TABLE errors (
+		id          INTEGER PRIMARY KEY,
+		run_id      INTEGER NOT NULL REFERENCES runs(id),
+		user_id     TEXT,
+		kind        TEXT NOT NULL,
+		message     TEXT NOT NULL,
+		occurred_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX user_stats_user ON user_stats(user_id);
+	CREATE INDEX errors_run ON errors(run_id);`,
+	// the day a run belongs to, which names its cache directory
+	`ALTER TABLE runs ADD COLUMN snapshot_date TEXT;
+	UPDATE runs SET snapshot_date = date(started_at, 'localtime');
+	CREATE INDEX runs_snapshot ON runs(snapshot_date, range_name);`,
+}
+
+// snapshotDateFormat formats the day a run belongs to, as in the .cache-2006-01-02 directories
+const snapshotDateFormat = "2006-01-02"
+
+// results of a run
+const (
+	runSucceeded = "success"
+	runFailed    = "failure"
+	// runImported holds data rebuilt from a cache directory by import-cache
+	runImported = "imported"
+)
+
+const (
+	breakdownLanguage        = "language"
+	breakdownEditor          = "editor"
+	breakdownOperatingSystem = "operating_system"
+)
+
+// Store is the SQLite database holding the history of every run.
+// A nil Store discards everything so collecting works without a database.
+type Store struct {
+	db *sql.DB
+}
+
+// OpenStore opens or creates the database at path and brings its schema up to date
+func OpenStore(path string) (*Store, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL&_foreign_keys=on")
+	if err != nil {
+		return nil, errorx.InitializationFailed.Wrap(err, "unable to open database "+path)
+	}
+	// sqlite allows a single writer, queue them here rather than on SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	s := &Store{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, errorx.InitializationFailed.Wrap(err, "unable to migrate database "+path)
+	}
+	return s, nil
+}
+
+func (s *Store) migrate() error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(storeMigrations); version++ {
+		err := s.transaction(func(tx *sql.Tx) error {
+			if _, err := tx.Exec(storeMigrations[version]); err != nil {
+				return err
+			}
+			// PRAGMA doesn't take parameters
+			_, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1))
+			return err
+		})
+		if err != nil {
+			return errorx.Decorate(err, "migration %d", version+1)
+		}
+	}
+	return nil
+}
+
+// transaction runs fn in a transaction committed only if fn succeeds
+func (s *Store) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// StartRun records the start of collecting rangeName and returns the id of the run
+func (s *Store) StartRun(rangeName string, started time.Time) (int64, error) {
+	if s == nil {
+		return 0, nil
+	}
+	res, err := s.db.Exec(`INSERT INTO runs (range_name, started_at, snapshot_date, version) VALUES (?, ?, ?, ?)`,
+		rangeName, started.UTC(), started.Format(snapshotDateFormat), GitSummary)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// FinishRun records how a run ended, rerr is nil for a successful run
+func (s *Store) FinishRun(runID int64, discovered, collected int, rerr error) error {
+	if s == nil {
+		return nil
+	}
+	result, message := runSucceeded, sql.NullString{}
+	if rerr != nil {
+		result, message = runFailed, sql.NullString{String: rerr.Error(), Valid: true}
+	}
+	_, err := s.db.Exec(`UPDATE runs SET finished_at = ?, result = ?, error = ?, users_discovered = ?, users_collected = ? WHERE id = ?`,
+		time.Now().UTC(), result, message, discovered, collected, runID)
+	return err
+}
+
+// ImportRun returns the run to import data for rangeName on the snapshot date of day into.
+// That is the latest run collected that day, so the import merges into it instead of
+// being counted twice, or else a run created the first time so importing again updates it.
+func (s *Store) ImportRun(rangeName string, day time.Time) (int64, error) {
+	if s == nil {
+		return 0, nil
+	}
+	var runID int64
+	err := s.db.QueryRow(`SELECT id FROM runs WHERE snapshot_date = ? AND range_name = ?
+		ORDER BY result IS ?, id DESC LIMIT 1`,
+		day.Format(snapshotDateFormat), rangeName, runImported).Scan(&runID)
+	if err != sql.ErrNoRows {
+		return runID, err
+	}
+	res, err := s.db.Exec(`INSERT INTO runs (range_name, started_at, finished_at, snapshot_date, result, version) VALUES (?, ?, ?, ?, ?, ?)`,
+		rangeName, day.UTC(), time.Now().UTC(), day.Format(snapshotDateFormat), runImported, GitSummary)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// SaveLeaderboardPage records the users and ranks on one page of a leader board fetched at seen
+func (s *Store) SaveLeaderboardPage(runID int64, rangeName string, page *models.Leaders, seen time.Time) error {
+	if s == nil {
+		return nil
+	}
+	seen = seen.UTC()
+	return s.transaction(func(tx *sql.Tx) error {
+		for _, rank := range page.Data {
+			if rank.User == nil {
+				continue
+			}
+			u := rank.User
+			_, err := tx.Exec(`INSERT INTO users (id, username, display_name, full_name, location, website, first_seen, last_seen)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT (id) DO UPDATE SET username = excluded.username, display_name = excluded.display_name,
+					full_name = excluded.full_name, location = excluded.location, website = excluded.website,
+					first_seen = MIN(first_seen, excluded.first_seen), last_seen = MAX(last_seen, excluded.last_seen)`,
+				u.ID, u.Username, u.DisplayName, u.FullName, u.Location, u.Website, seen, seen)
+			if err != nil {
+				return err
+			}
+			var total float64
+			var average int64
+			if rank.RunningTotal != nil {
+				total, average = rank.RunningTotal.TotalSeconds, rank.RunningTotal.DailyAverage
+			}
+			_, err = tx.Exec(`INSERT OR REPLACE INTO leaderboard_snapshots (run_id, range_name, page, rank, user_id, total_seconds, daily_average)
+				VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				runID, rangeName, page.Page, rank.Rank, u.ID, total, average)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SaveUserStats records the stats of a user collected at along with their language, editor and
+// operating system breakdowns
+func (s *Store) SaveUserStats(runID int64, userID string, stats *models.Stats, collected time.Time) error {
+	if s == nil || stats == nil {
+		return nil
+	}
+	collected = collected.UTC()
+	return s.transaction(func(tx *sql.Tx) error {
+		// users only reached through users.tmp were never seen on a leader board this run
+		_, err := tx.Exec(`INSERT INTO users (id, username, first_seen, last_seen) VALUES (?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`,
+			userID, stats.Username, collected, collected)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM stat_breakdowns WHERE run_id = ? AND user_id = ?`, runID, userID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT OR REPLACE INTO user_stats (run_id, user_id, range_name, range_start, range_end, timezone, total_seconds,
+				daily_average, days_including_holidays, status, collected_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			runID, userID, stats.Range, nullTime(stats.Start), nullTime(stats.End), stats.Timezone, stats.TotalSeconds,
+			stats.DailyAverage, stats.DaysIncludingHolidays, stats.Status, collected)
+		if err != nil {
+			return err
+		}
+		breakdowns := map[string][]*models.StatsCategory{
+			breakdownLanguage:        stats.Languages,
+			breakdownEditor:          stats.Editors,
+			breakdownOperatingSystem: stats.OperatingSystems,
+		}
+		for category, items := range breakdowns {
+			for _, item := range items {
+				if item == nil {
+					continue
+				}
+				_, err := tx.Exec(`INSERT OR REPLACE INTO stat_breakdowns (run_id, user_id, category, name, total_seconds, percent)
+					VALUES (?, ?, ?, ?, ?, ?)`,
+					runID, userID, category, item.Name, item.TotalSeconds, item.Percent)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// SaveError records an error hit while collecting userID, which may be empty
+func (s *Store) SaveError(runID int64, userID, kind string, cause error) error {
+	if s == nil {
+		return nil
+	}
+	user := sql.NullString{String: userID, Valid: userID != ""}
+	_, err := s.db.Exec(`INSERT INTO errors (run_id, user_id, kind, message, occurred_at) VALUES (?, ?, ?, ?, ?)`,
+		runID, user, kind, cause.Error(), time.Now().UTC())
+	return err
+}
+
+// PreviousRun summarizes the last finished run of rangeName before runID, nil when there is none
+func (s *Store) PreviousRun(rangeName string, runID int64) (*RunSummary, error) {
+	if s == nil {
+		return nil, nil
+	}
+	p := &RunSummary{Range: rangeName, Errors: map[string]int{}}
+	err := s.db.QueryRow(`SELECT id, started_at, finished_at, result, COALESCE(error, ''), COALESCE(version, ''),
+			COALESCE(users_discovered, 0), COALESCE(users_collected, 0),
+			(SELECT COUNT(*) FROM user_stats WHERE user_stats.run_id = runs.id)
+		FROM runs WHERE range_name = ? AND id < ? AND finished_at IS NOT NULL AND result != ?
+		ORDER BY id DESC LIMIT 1`, rangeName, runID, runImported).
+		Scan(&p.RunID, &p.Started, &p.Finished, &p.Result, &p.Error, &p.Version, &p.Discovered, &p.Collected, &p.CollectedThisRun)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT kind, COUNT(*) FROM errors WHERE run_id = ? GROUP BY kind`, p.RunID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind string
+		var n int
+		if err := rows.Scan(&kind, &n); err != nil {
+			return nil, err
+		}
+		p.Errors[kind] = n
+	}
+	return p, rows.Err()
+}
+
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func nullTime(t strfmt.DateTime) sql.NullTime {
+	if time.Time(t).IsZero() {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: time.Time(t).UTC(), Valid: true}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/will7200/go-wakatime/models"
+)
+
+func TestStore_RecordsRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "wakatime.db")
+
+	s, err := OpenStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runID, err := s.StartRun("last_7_days", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	username := "alice"
+	page := &models.Leaders{
+		Page: 1,
+		Data: []*models.LeadersRank{
+			{Rank: 1, User: &models.LeadersRankUser{ID: "a", Username: &username}, RunningTotal: &models.LeadersRankRunningTotal{TotalSeconds: 3600}},
+			{Rank: 2, User: &models.LeadersRankUser{ID: "b"}},
+		},
+	}
+	if err := s.SaveLeaderboardPage(runID, "last_7_days", page, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	// pages may be fetched more than once
+	if err := s.SaveLeaderboardPage(runID, "last_7_days", page, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	stats := &models.Stats{
+		TotalSeconds:     3600,
+		Languages:        []*models.StatsCategory{{Name: "Go", TotalSeconds: 3000, Percent: 83.3}, {Name: "SQL", TotalSeconds: 600}},
+		Editors:          []*models.StatsCategory{{Name: "Vim", TotalSeconds: 3600}},
+		OperatingSystems: []*models.StatsCategory{{Name: "Linux", TotalSeconds: 3600}},
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.SaveUserStats(runID, "a", stats, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SaveError(runID, "b", "timeout", errors.New("timed out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.FinishRun(runID, 2, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopening must not run the migrations again
+	s, err = OpenStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	counts := map[string]int{
+		"SELECT COUNT(*) FROM users":                                                 2,
+		"SELECT COUNT(*) FROM leaderboard_snapshots":                                 2,
+		"SELECT COUNT(*) FROM user_stats":                                            1,
+		"SELECT COUNT(*) FROM stat_breakdowns WHERE category = 'language'":           2,
+		"SELECT COUNT(*) FROM stat_breakdowns":                                       4,
+		"SELECT COUNT(*) FROM errors WHERE user_id = 'b'":                            1,
+		"SELECT COUNT(*) FROM runs WHERE result = 'success' AND users_collected = 1": 1,
+	}
+	for query, want := range counts {
+		var got int
+		if err := s.db.QueryRow(query).Scan(&got); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		if got != want {
+			t.Errorf("%s = %d, want %d", query, got, want)
+		}
+	}
+}
+
+func testLeaderboardPage() *models.Leaders {
+	username := "alice"
+	return &models.Leaders{
+		Page: 1,
+		Data: []*models.LeadersRank{
+			{Rank: 1, User: &models.LeadersRankUser{ID: "a", Username: &username}, RunningTotal: &models.LeadersRankRunningTotal{TotalSeconds: 3600}},
+			{Rank: 2, User: &models.LeadersRankUser{ID: "b"}},
+		},
+	}
+}
+
+func testStats() *models.Stats {
+	return &models.Stats{
+		TotalSeconds:     3600,
+		Languages:        []*models.StatsCategory{{Name: "Go", TotalSeconds: 3000, Percent: 83.3}, {Name: "SQL", TotalSeconds: 600}},
+		Editors:          []*models.StatsCategory{{Name: "Vim", TotalSeconds: 3600}},
+		OperatingSystems: []*models.StatsCategory{{Name: "Linux", TotalSeconds: 3600}},
+	}
+}
+
+// recordTestRun records a run of the 7 day board where a was collected and b timed out
+func recordTestRun(t *testing.T, s *Store, started time.Time) int64 {
+	runID, err := s.StartRun("last_7_days", started)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveLeaderboardPage(runID, "last_7_days", testLeaderboardPage(), started); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveUserStats(runID, "a", testStats(), started); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveError(runID, "b", "timeout", errors.New("timed out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.FinishRun(runID, 2, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	return runID
+}
+
+func TestStore_NilDiscards(t *testing.T) {
+	var s *Store
+	runID, err := s.StartRun("last_7_days", time.Now())
+	if err != nil || runID != 0 {
+		t.Errorf("StartRun() = %d, %v", runID, err)
+	}
+	if err := s.SaveUserStats(runID, "a", &models.Stats{}, time.Now()); err != nil {
+		t.Error(err)
+	}
+	if err := s.FinishRun(runID, 0, 0, errors.New("failed")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStore_BackfillsSnapshotDates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "wakatime.db")
+
+	// a database from before runs had a snapshot date
+	db, err := sql.Open("sqlite3", "file:"+file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Date(2019, 1, 1, 23, 30, 0, 0, time.Local)
+	for _, query := range []string{storeMigrations[0], "PRAGMA user_version = 1"} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(`INSERT INTO runs (range_name, started_at) VALUES (?, ?)`, "last_7_days", started.UTC()); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	s, err := OpenStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var date string
+	if err := s.db.QueryRow(`SELECT snapshot_date FROM runs`).Scan(&date); err != nil {
+		t.Fatal(err)
+	}
+	if want := started.Format(snapshotDateFormat); date != want {
+		t.Errorf("snapshot_date = %s, want the local date %s as StartRun records it", date, want)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits how often something may happen to rate per second with bursts of up to burst
+type tokenBucket struct {
+	rate         float64
+	burst        float64
+	tokens       float64
+	last         time.Time
+	blockedUntil time.Time
+	lock         sync.Mutex
+
+	now func() time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), now: time.Now}
+}
+
+// reserve takes a token and returns how long to wait before using it.
+// Tokens may go negative so concurrent callers queue up behind each other.
+func (b *tokenBucket) reserve() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := b.now()
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	b.tokens--
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	if blocked := b.blockedUntil.Sub(now); blocked > wait {
+		wait = blocked
+	}
+	return wait
+}
+
+// Wait blocks until a token is available
+func (b *tokenBucket) Wait() {
+	if wait := b.reserve(); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Pause holds back every reservation for d, as asked by a Retry-After header
+func (b *tokenBucket) Pause(d time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if until := b.now().Add(d); until.After(b.blockedUntil) {
+		b.blockedUntil = until
+	}
+}